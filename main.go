@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/russross/meddler"
 
@@ -60,9 +61,24 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:   "target-database-encryption-key",
-			Usage:  "target database-encryption-key",
+			Usage:  "target database-encryption-key (32 characters, or base64: or hex: prefixed)",
 			EnvVar: "TARGET_DATABASE_ENCRYPTION_KEY",
 		},
+		cli.StringFlag{
+			Name:   "target-database-old-encryption-key",
+			Usage:  "previous target database-encryption-key, used for key rotation",
+			EnvVar: "TARGET_DATABASE_OLD_ENCRYPTION_KEY",
+		},
+		cli.StringFlag{
+			Name:   "target-database-encryption-key-file",
+			Usage:  "file containing the target database-encryption-key",
+			EnvVar: "TARGET_DATABASE_ENCRYPTION_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "target-database-old-encryption-key-file",
+			Usage:  "file containing the previous target database-encryption-key",
+			EnvVar: "TARGET_DATABASE_OLD_ENCRYPTION_KEY_FILE",
+		},
 		cli.StringFlag{
 			Name:   "drone-server",
 			Usage:  "target drone server address",
@@ -108,6 +124,124 @@ func main() {
 			Usage:  "s3 path prefix (optional)",
 			EnvVar: "S3_PREFIX",
 		},
+		cli.BoolFlag{
+			Name:   "s3-gzip",
+			Usage:  "gzip compress logs uploaded to s3 (optional)",
+			EnvVar: "S3_GZIP",
+		},
+		cli.StringFlag{
+			Name:   "s3-encryption",
+			Usage:  "s3 server-side encryption algorithm, AES256 or aws:kms (optional)",
+			EnvVar: "S3_ENCRYPTION",
+		},
+		cli.StringFlag{
+			Name:   "s3-kms-key-id",
+			Usage:  "s3 server-side encryption kms key id (optional)",
+			EnvVar: "S3_KMS_KEY_ID",
+		},
+		cli.StringFlag{
+			Name:   "s3-storage-class",
+			Usage:  "s3 storage class (optional)",
+			EnvVar: "S3_STORAGE_CLASS",
+		},
+		cli.BoolFlag{
+			Name:   "s3-metadata",
+			Usage:  "add repository, build and step object metadata (optional)",
+			EnvVar: "S3_METADATA",
+		},
+		cli.BoolFlag{
+			Name:   "s3-tagging",
+			Usage:  "add repository, build and step object tags (optional)",
+			EnvVar: "S3_TAGGING",
+		},
+		cli.BoolFlag{
+			Name:   "s3-resume",
+			Usage:  "skip logs already uploaded to s3 with a matching size and checksum (optional)",
+			EnvVar: "S3_RESUME",
+		},
+		cli.BoolFlag{
+			Name:   "s3-verify",
+			Usage:  "verify the size and checksum of logs after upload (optional)",
+			EnvVar: "S3_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "s3-retry-file",
+			Usage:  "write failed or mismatched uploads to this file (optional)",
+			EnvVar: "S3_RETRY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "s3-retry-from",
+			Usage:  "only upload logs listed in this retry file (optional)",
+			EnvVar: "S3_RETRY_FROM",
+		},
+		cli.StringFlag{
+			Name:   "export-dir",
+			Usage:  "export to this local directory (optional for export-logs, which defaults to s3)",
+			EnvVar: "EXPORT_DIR",
+		},
+		cli.StringFlag{
+			Name:   "k8s-namespace",
+			Usage:  "kubernetes namespace of exported secrets (optional)",
+			EnvVar: "K8S_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   "k8s-scope",
+			Usage:  "export one kubernetes secret per repo or namespace",
+			EnvVar: "K8S_SCOPE",
+			Value:  "repo",
+		},
+		cli.StringFlag{
+			Name:   "k8s-name-format",
+			Usage:  "kubernetes secret name template, e.g. drone-{{ .Namespace }}-{{ .Name }} (optional)",
+			EnvVar: "K8S_NAME_FORMAT",
+		},
+		cli.BoolFlag{
+			Name:   "k8s-registries",
+			Usage:  "export registry credentials as kubernetes secrets (optional)",
+			EnvVar: "K8S_REGISTRIES",
+		},
+		cli.StringFlag{
+			Name:   "vault-addr",
+			Usage:  "vault server address",
+			EnvVar: "VAULT_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "vault-token",
+			Usage:  "vault token",
+			EnvVar: "VAULT_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "vault-mount",
+			Usage:  "vault kv version 2 secrets engine path",
+			EnvVar: "VAULT_MOUNT",
+			Value:  "secret",
+		},
+		cli.StringFlag{
+			Name:   "vault-prefix",
+			Usage:  "vault secret path prefix",
+			EnvVar: "VAULT_PREFIX",
+			Value:  "drone",
+		},
+		cli.StringFlag{
+			Name:   "vault-bundle",
+			Usage:  "write secrets to this json file instead of vault (optional)",
+			EnvVar: "VAULT_BUNDLE",
+		},
+		cli.DurationFlag{
+			Name:   "log-max-age",
+			Usage:  "skip logs for steps older than this duration, e.g. 8760h (optional)",
+			EnvVar: "LOG_MAX_AGE",
+		},
+		cli.Int64Flag{
+			Name:   "log-max-size",
+			Usage:  "truncate step logs larger than this number of bytes, at least 1024 (optional)",
+			EnvVar: "LOG_MAX_SIZE",
+		},
+		cli.BoolFlag{
+			Name:   "log-keep-tail",
+			Usage:  "keep the end of truncated logs instead of the beginning (optional)",
+			EnvVar: "LOG_KEEP_TAIL",
+		},
 		cli.Int64Flag{
 			Name:   "build-id",
 			Usage:  "start uploading builds from this build id (optional)",
@@ -118,6 +252,83 @@ func main() {
 			Usage:  "enable debug mode",
 			EnvVar: "DEBUG",
 		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "print a report without making changes",
+			EnvVar: "DRY_RUN",
+		},
+		cli.IntFlag{
+			Name:   "min-repos",
+			Usage:  "minimum number of repositories sharing a secret to promote it",
+			EnvVar: "MIN_REPOS",
+			Value:  2,
+		},
+		cli.BoolFlag{
+			Name:   "delete-repo-secrets",
+			Usage:  "delete repository secrets once promoted to organization secrets",
+			EnvVar: "DELETE_REPO_SECRETS",
+		},
+		cli.BoolFlag{
+			Name:   "registry-org-secrets",
+			Usage:  "write registry credentials shared by a namespace as organization secrets",
+			EnvVar: "REGISTRY_ORG_SECRETS",
+		},
+		cli.StringFlag{
+			Name:   "rename-rules-file",
+			Usage:  "json file with the repository rename rules (optional)",
+			EnvVar: "RENAME_RULES_FILE",
+		},
+		cli.StringFlag{
+			Name:   "scm-host-from",
+			Usage:  "web url of the old scm host, for example https://github.com",
+			EnvVar: "SCM_HOST_FROM",
+		},
+		cli.StringFlag{
+			Name:   "scm-host-to",
+			Usage:  "web url of the new scm host, for example https://github.company.com",
+			EnvVar: "SCM_HOST_TO",
+		},
+		cli.StringFlag{
+			Name:   "scm-host-rules-file",
+			Usage:  "json file with the namespace rename rules of the new scm host (optional)",
+			EnvVar: "SCM_HOST_RULES_FILE",
+		},
+		cli.StringFlag{
+			Name:   "preflight-strategy",
+			Usage:  "preflight conflict resolution strategy, keep-newest, keep-active or rename (optional)",
+			EnvVar: "PREFLIGHT_STRATEGY",
+		},
+		cli.BoolFlag{
+			Name:   "preserve-tokens",
+			Usage:  "preserve the 0.x user tokens (optional)",
+			EnvVar: "PRESERVE_TOKENS",
+		},
+		cli.StringFlag{
+			Name:   "token-file",
+			Usage:  "write the migrated user tokens to this file (optional)",
+			EnvVar: "TOKEN_FILE",
+		},
+		cli.StringFlag{
+			Name:   "token-format",
+			Usage:  "token file format, json, csv or env",
+			EnvVar: "TOKEN_FORMAT",
+			Value:  "json",
+		},
+		cli.StringFlag{
+			Name:   "admins",
+			Usage:  "comma-separated list of users granted admin access (optional)",
+			EnvVar: "ADMINS",
+		},
+		cli.StringFlag{
+			Name:   "machine-users",
+			Usage:  "comma-separated list of machine users to create (optional)",
+			EnvVar: "MACHINE_USERS",
+		},
+		cli.BoolFlag{
+			Name:   "activate-all-users",
+			Usage:  "migrate all users as active, ignoring the 0.8 active flag",
+			EnvVar: "ACTIVATE_ALL_USERS",
+		},
 		cli.StringFlag{
 			Name:   "token",
 			Usage:  "override the SCM token used to make some requests",
@@ -128,6 +339,36 @@ func main() {
 			Usage:  "override the SCM token for specific namespaces",
 			EnvVar: "ORGS",
 		},
+		cli.BoolFlag{
+			Name:   "refresh-metadata",
+			Usage:  "update the repository metadata with update-repos (optional)",
+			EnvVar: "REFRESH_METADATA",
+		},
+		cli.BoolFlag{
+			Name:   "merge-renamed",
+			Usage:  "merge renamed repositories that collide with an existing repository (optional)",
+			EnvVar: "MERGE_RENAMED",
+		},
+		cli.BoolFlag{
+			Name:   "collaborator-fallback",
+			Usage:  "use the token of other users with push access when the repository owner token fails (optional)",
+			EnvVar: "COLLABORATOR_FALLBACK",
+		},
+		cli.BoolFlag{
+			Name:   "reassign-owner",
+			Usage:  "reassign the repository owner to the collaborator used by the fallback (optional)",
+			EnvVar: "REASSIGN_OWNER",
+		},
+		cli.StringSliceFlag{
+			Name:   "token-override",
+			Usage:  "override the SCM token for a namespace, in the format namespace=token, or *=token for all other namespaces",
+			EnvVar: "TOKEN_OVERRIDES",
+		},
+		cli.StringFlag{
+			Name:   "token-overrides-file",
+			Usage:  "file with one namespace=token override per line (optional)",
+			EnvVar: "TOKEN_OVERRIDES_FILE",
+		},
 	}
 
 	app.Before = func(c *cli.Context) error {
@@ -168,6 +409,33 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "preflight",
+			Usage: "check the source database for unique key conflicts",
+			Action: func(c *cli.Context) error {
+				source, err := sql.Open(
+					c.GlobalString("source-database-driver"),
+					c.GlobalString("source-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				rules, err := renameRules(c, "rename-rules-file")
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.Preflight(source, os.Stdout, migrate.PreflightOptions{
+					Driver:         c.GlobalString("target-database-driver"),
+					Strategy:       c.GlobalString("preflight-strategy"),
+					PreserveTokens: c.GlobalBool("preserve-tokens"),
+					Rules:          rules,
+				})
+			},
+		},
 		{
 			Name:  "migrate-users",
 			Usage: "migrate user resources",
@@ -190,12 +458,560 @@ func main() {
 					return err
 				}
 
-				return migrate.MigrateUsers(source, target)
+				return migrate.MigrateUsers(source, target, migrate.UserOptions{
+					PreserveTokens: c.GlobalBool("preserve-tokens"),
+					TokenFile:      c.GlobalString("token-file"),
+					TokenFormat:    c.GlobalString("token-format"),
+					Server:         c.GlobalString("drone-server"),
+					Admins:         splitList(c.GlobalString("admins")),
+					MachineUsers:   splitList(c.GlobalString("machine-users")),
+					ActivateAll:    c.GlobalBool("activate-all-users"),
+				})
+			},
+		},
+		{
+			Name:  "update-users",
+			Usage: "update user metadata",
+			Action: func(c *cli.Context) error {
+				var (
+					driver     = c.GlobalString("target-database-driver")
+					datasource = c.GlobalString("target-database-datasource")
+					provider   = c.GlobalString("scm-driver")
+					server     = c.GlobalString("scm-server")
+				)
+
+				logrus.Debugf("target database driver: %s", driver)
+				logrus.Debugf("target database datasource: %s", datasource)
+				logrus.Debugf("scm driver: %s", provider)
+				logrus.Debugf("scm server: %s", server)
+
+				target, err := sql.Open(driver, datasource)
+
+				if err != nil {
+					return err
+				}
+
+				client, err := createClient(c)
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.UpdateUsers(target, client, os.Stdout, c.GlobalBool("dry-run"))
+			},
+		},
+		{
+			Name:  "check-tokens",
+			Usage: "check and refresh user tokens",
+			Action: func(c *cli.Context) error {
+				var (
+					driver     = c.GlobalString("target-database-driver")
+					datasource = c.GlobalString("target-database-datasource")
+					provider   = c.GlobalString("scm-driver")
+					server     = c.GlobalString("scm-server")
+				)
+
+				logrus.Debugf("target database driver: %s", driver)
+				logrus.Debugf("target database datasource: %s", datasource)
+				logrus.Debugf("scm driver: %s", provider)
+				logrus.Debugf("scm server: %s", server)
+
+				target, err := sql.Open(driver, datasource)
+
+				if err != nil {
+					return err
+				}
+
+				client, err := createClient(c)
+
+				if err != nil {
+					return err
+				}
+
+				// only the bitbucket driver is configured with
+				// the oauth2 client credentials required to
+				// refresh tokens.
+				var refresher migrate.TokenRefresher
+				if provider == "bitbucket" {
+					refresher = bitbucketRefresher(c)
+				}
+
+				return migrate.CheckTokens(target, client, refresher, os.Stdout)
+			},
+		},
+		{
+			Name:  "migrate-repos",
+			Usage: "migrate repository resources",
+			Action: func(c *cli.Context) error {
+				source, err := sql.Open(
+					c.GlobalString("source-database-driver"),
+					c.GlobalString("source-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				rules, err := renameRules(c, "rename-rules-file")
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.MigrateRepos(source, target, rules)
+			},
+		},
+		{
+			Name:  "update-repos",
+			Usage: "update repository metadata",
+			Action: func(c *cli.Context) error {
+				var (
+					driver     = c.GlobalString("target-database-driver")
+					datasource = c.GlobalString("target-database-datasource")
+					provider   = c.GlobalString("scm-driver")
+					server     = c.GlobalString("scm-server")
+				)
+
+				logrus.Debugf("target database driver: %s", driver)
+				logrus.Debugf("target database datasource: %s", datasource)
+				logrus.Debugf("scm driver: %s", provider)
+				logrus.Debugf("scm server: %s", server)
+
+				target, err := sql.Open(driver, datasource)
+
+				if err != nil {
+					return err
+				}
+
+				client, err := createClient(c)
+
+				if err != nil {
+					return err
+				}
+
+				overrides, err := tokenOverrides(c)
+
+				if err != nil {
+					return err
+				}
+
+				collaborators, err := collaboratorFallback(c)
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.UpdateRepoIdentifiers(target, client, migrate.RepoOptions{
+					Overrides:     overrides,
+					Collaborators: collaborators,
+					Metadata:      c.GlobalBool("refresh-metadata"),
+					DryRun:        c.GlobalBool("dry-run"),
+				}, os.Stdout)
+			},
+		},
+		{
+			Name:  "refresh-repos",
+			Usage: "refresh repository metadata",
+			Action: func(c *cli.Context) error {
+				var (
+					driver     = c.GlobalString("target-database-driver")
+					datasource = c.GlobalString("target-database-datasource")
+					provider   = c.GlobalString("scm-driver")
+					server     = c.GlobalString("scm-server")
+				)
+
+				logrus.Debugf("target database driver: %s", driver)
+				logrus.Debugf("target database datasource: %s", datasource)
+				logrus.Debugf("scm driver: %s", provider)
+				logrus.Debugf("scm server: %s", server)
+
+				target, err := sql.Open(driver, datasource)
+
+				if err != nil {
+					return err
+				}
+
+				client, err := createClient(c)
+
+				if err != nil {
+					return err
+				}
+
+				overrides, err := tokenOverrides(c)
+
+				if err != nil {
+					return err
+				}
+
+				collaborators, err := collaboratorFallback(c)
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.RefreshRepoMetadata(target, client, migrate.RepoOptions{
+					Overrides:     overrides,
+					Collaborators: collaborators,
+					DryRun:        c.GlobalBool("dry-run"),
+				}, os.Stdout)
+			},
+		},
+		{
+			Name:  "reconcile-renamed",
+			Usage: "rename or merge renamed repositories",
+			Action: func(c *cli.Context) error {
+				var (
+					driver     = c.GlobalString("target-database-driver")
+					datasource = c.GlobalString("target-database-datasource")
+					provider   = c.GlobalString("scm-driver")
+					server     = c.GlobalString("scm-server")
+				)
+
+				logrus.Debugf("target database driver: %s", driver)
+				logrus.Debugf("target database datasource: %s", datasource)
+				logrus.Debugf("scm driver: %s", provider)
+				logrus.Debugf("scm server: %s", server)
+
+				target, err := sql.Open(driver, datasource)
+
+				if err != nil {
+					return err
+				}
+
+				client, err := createClient(c)
+
+				if err != nil {
+					return err
+				}
+
+				overrides, err := tokenOverrides(c)
+
+				if err != nil {
+					return err
+				}
+
+				collaborators, err := collaboratorFallback(c)
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.ReconcileRenamed(target, client, migrate.RepoOptions{
+					Overrides:     overrides,
+					Collaborators: collaborators,
+					DryRun:        c.GlobalBool("dry-run"),
+				}, c.GlobalBool("merge-renamed"), os.Stdout)
+			},
+		},
+		{
+			Name:  "migrate-scm-host",
+			Usage: "move the repositories to a different scm host",
+			Action: func(c *cli.Context) error {
+				var (
+					driver     = c.GlobalString("target-database-driver")
+					datasource = c.GlobalString("target-database-datasource")
+				)
+
+				logrus.Debugf("target database driver: %s", driver)
+				logrus.Debugf("target database datasource: %s", datasource)
+
+				target, err := sql.Open(driver, datasource)
+
+				if err != nil {
+					return err
+				}
+
+				rules, err := renameRules(c, "scm-host-rules-file")
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.MigrateSCMHost(target, os.Stdout, migrate.HostOptions{
+					OldURL: c.GlobalString("scm-host-from"),
+					NewURL: c.GlobalString("scm-host-to"),
+					Rules:  rules,
+					DryRun: c.GlobalBool("dry-run"),
+				})
+			},
+		},
+		{
+			Name:  "remove-renamed",
+			Usage: "remove renamed repositories",
+			Action: func(c *cli.Context) error {
+				var (
+					driver     = c.GlobalString("target-database-driver")
+					datasource = c.GlobalString("target-database-datasource")
+					provider   = c.GlobalString("scm-driver")
+					server     = c.GlobalString("scm-server")
+				)
+
+				logrus.Debugf("target database driver: %s", driver)
+				logrus.Debugf("target database datasource: %s", datasource)
+				logrus.Debugf("scm driver: %s", provider)
+				logrus.Debugf("scm server: %s", server)
+
+				target, err := sql.Open(driver, datasource)
+
+				if err != nil {
+					return err
+				}
+
+				client, err := createClient(c)
+
+				if err != nil {
+					return err
+				}
+
+				overrides, err := tokenOverrides(c)
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.RemoveRenamed(target, client, overrides)
+			},
+		},
+		{
+			Name:  "remove-not-found",
+			Usage: "remove not found repositories",
+			Action: func(c *cli.Context) error {
+				var (
+					driver     = c.GlobalString("target-database-driver")
+					datasource = c.GlobalString("target-database-datasource")
+					provider   = c.GlobalString("scm-driver")
+					server     = c.GlobalString("scm-server")
+				)
+
+				logrus.Debugf("target database driver: %s", driver)
+				logrus.Debugf("target database datasource: %s", datasource)
+				logrus.Debugf("scm driver: %s", provider)
+				logrus.Debugf("scm server: %s", server)
+
+				target, err := sql.Open(driver, datasource)
+
+				if err != nil {
+					return err
+				}
+
+				client, err := createClient(c)
+
+				if err != nil {
+					return err
+				}
+
+				overrides, err := tokenOverrides(c)
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.RemoveNotFound(target, client, overrides)
+			},
+		},
+		{
+			Name:  "migrate-builds",
+			Usage: "migrate drone builds",
+			Action: func(c *cli.Context) error {
+				source, err := sql.Open(
+					c.GlobalString("source-database-driver"),
+					c.GlobalString("source-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				buildId := c.GlobalInt64("build-id")
+
+				return migrate.MigrateBuilds(source, target, buildId)
+			},
+		},
+
+		{
+			Name:  "migrate-stages",
+			Usage: "migrate drone stages",
+			Action: func(c *cli.Context) error {
+				source, err := sql.Open(
+					c.GlobalString("source-database-driver"),
+					c.GlobalString("source-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				buildId := c.GlobalInt64("build-id")
+
+				return migrate.MigrateStages(source, target, buildId)
+			},
+		},
+		{
+			Name:  "migrate-steps",
+			Usage: "migrate drone steps",
+			Action: func(c *cli.Context) error {
+				source, err := sql.Open(
+					c.GlobalString("source-database-driver"),
+					c.GlobalString("source-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				buildId := c.GlobalInt64("build-id")
+
+				return migrate.MigrateSteps(source, target, buildId)
+			},
+		},
+		{
+			Name:  "migrate-logs",
+			Usage: "migrate drone logs",
+			Action: func(c *cli.Context) error {
+				source, err := sql.Open(
+					c.GlobalString("source-database-driver"),
+					c.GlobalString("source-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				buildId := c.GlobalInt64("build-id")
+
+				return migrate.MigrateLogs(source, target, buildId, logLimits(c))
+			},
+		},
+		{
+			Name:  "migrate-logs-s3",
+			Usage: "migrate drone logs to s3",
+			Action: func(c *cli.Context) error {
+				source, err := sql.Open(
+					c.GlobalString("source-database-driver"),
+					c.GlobalString("source-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				buildId := c.GlobalInt64("build-id")
+				return migrate.MigrateLogsS3(source, buildId, s3Options(c))
+			},
+		},
+		{
+			Name:  "export-logs",
+			Usage: "export drone logs as per-build archives",
+			Action: func(c *cli.Context) error {
+				source, err := sql.Open(
+					c.GlobalString("source-database-driver"),
+					c.GlobalString("source-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				var store migrate.ArchiveStore
+				switch {
+				case c.GlobalString("export-dir") != "":
+					store = migrate.NewArchiveDir(c.GlobalString("export-dir"))
+				case c.GlobalString("s3-bucket") != "":
+					store, err = migrate.NewArchiveS3(s3Options(c))
+					if err != nil {
+						return err
+					}
+				default:
+					return errors.New("Export directory or s3 bucket not configured")
+				}
+
+				buildId := c.GlobalInt64("build-id")
+				return migrate.ExportLogs(source, store, buildId)
+			},
+		},
+		{
+			Name:  "migrate-secrets",
+			Usage: "migrate drone secrets",
+			Action: func(c *cli.Context) error {
+				source, err := sql.Open(
+					c.GlobalString("source-database-driver"),
+					c.GlobalString("source-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				key, err := encryptionKey(c, "target-database-encryption-key")
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.MigrateSecrets(
+					source,
+					target,
+					key,
+				)
 			},
 		},
 		{
-			Name:  "migrate-repos",
-			Usage: "migrate repository resources",
+			Name:  "migrate-registries",
+			Usage: "migrate registry credentials",
 			Action: func(c *cli.Context) error {
 				source, err := sql.Open(
 					c.GlobalString("source-database-driver"),
@@ -215,107 +1031,74 @@ func main() {
 					return err
 				}
 
-				return migrate.MigrateRepos(source, target)
-			},
-		},
-		{
-			Name:  "update-repos",
-			Usage: "update repository metadata",
-			Action: func(c *cli.Context) error {
-				var (
-					driver     = c.GlobalString("target-database-driver")
-					datasource = c.GlobalString("target-database-datasource")
-					provider   = c.GlobalString("scm-driver")
-					server     = c.GlobalString("scm-server")
-					token			 = c.GlobalString("token")
-					orgs			 = c.GlobalString("orgs")
-				)
-
-				logrus.Debugf("target database driver: %s", driver)
-				logrus.Debugf("target database datasource: %s", datasource)
-				logrus.Debugf("scm driver: %s", provider)
-				logrus.Debugf("scm server: %s", server)
-
-				target, err := sql.Open(driver, datasource)
+				key, err := encryptionKey(c, "target-database-encryption-key")
 
 				if err != nil {
 					return err
 				}
 
-				client, err := createClient(c)
+				rules, err := renameRules(c, "rename-rules-file")
 
 				if err != nil {
 					return err
 				}
 
-				return migrate.UpdateRepoIdentifiers(target, client, token, orgs)
+				return migrate.MigrateRegistries(
+					source,
+					target,
+					key,
+					c.GlobalBool("registry-org-secrets"),
+					rules,
+				)
 			},
 		},
 		{
-			Name:  "remove-renamed",
-			Usage: "remove renamed repositories",
+			Name:  "report-secret-restrictions",
+			Usage: "report secret restrictions that cannot be migrated",
 			Action: func(c *cli.Context) error {
-				var (
-					driver     = c.GlobalString("target-database-driver")
-					datasource = c.GlobalString("target-database-datasource")
-					provider   = c.GlobalString("scm-driver")
-					server     = c.GlobalString("scm-server")
+				source, err := sql.Open(
+					c.GlobalString("source-database-driver"),
+					c.GlobalString("source-database-datasource"),
 				)
 
-				logrus.Debugf("target database driver: %s", driver)
-				logrus.Debugf("target database datasource: %s", datasource)
-				logrus.Debugf("scm driver: %s", provider)
-				logrus.Debugf("scm server: %s", server)
-
-				target, err := sql.Open(driver, datasource)
-
 				if err != nil {
 					return err
 				}
 
-				client, err := createClient(c)
+				rules, err := renameRules(c, "rename-rules-file")
 
 				if err != nil {
 					return err
 				}
 
-				return migrate.RemoveRenamed(target, client)
+				return migrate.ReportSecretRestrictions(source, os.Stdout, rules)
 			},
 		},
 		{
-			Name:  "remove-not-found",
-			Usage: "remove not found repositories",
+			Name:  "report-image-pull-secrets",
+			Usage: "report repositories that require image_pull_secrets",
 			Action: func(c *cli.Context) error {
-				var (
-					driver     = c.GlobalString("target-database-driver")
-					datasource = c.GlobalString("target-database-datasource")
-					provider   = c.GlobalString("scm-driver")
-					server     = c.GlobalString("scm-server")
+				source, err := sql.Open(
+					c.GlobalString("source-database-driver"),
+					c.GlobalString("source-database-datasource"),
 				)
 
-				logrus.Debugf("target database driver: %s", driver)
-				logrus.Debugf("target database datasource: %s", datasource)
-				logrus.Debugf("scm driver: %s", provider)
-				logrus.Debugf("scm server: %s", server)
-
-				target, err := sql.Open(driver, datasource)
-
 				if err != nil {
 					return err
 				}
 
-				client, err := createClient(c)
+				rules, err := renameRules(c, "rename-rules-file")
 
 				if err != nil {
 					return err
 				}
 
-				return migrate.RemoveNotFound(target, client)
+				return migrate.ReportImagePullSecrets(source, os.Stdout, rules)
 			},
 		},
 		{
-			Name:  "migrate-builds",
-			Usage: "migrate drone builds",
+			Name:  "export-encrypted-secrets",
+			Usage: "export secrets as encrypted secret yaml documents",
 			Action: func(c *cli.Context) error {
 				source, err := sql.Open(
 					c.GlobalString("source-database-driver"),
@@ -335,15 +1118,16 @@ func main() {
 					return err
 				}
 
-				buildId := c.GlobalInt64("build-id")
-
-				return migrate.MigrateBuilds(source, target, buildId)
+				return migrate.ExportEncryptedSecrets(
+					source,
+					target,
+					c.GlobalString("export-dir"),
+				)
 			},
 		},
-
 		{
-			Name:  "migrate-stages",
-			Usage: "migrate drone stages",
+			Name:  "export-k8s-secrets",
+			Usage: "export secrets as kubernetes secret manifests",
 			Action: func(c *cli.Context) error {
 				source, err := sql.Open(
 					c.GlobalString("source-database-driver"),
@@ -354,23 +1138,25 @@ func main() {
 					return err
 				}
 
-				target, err := sql.Open(
-					c.GlobalString("target-database-driver"),
-					c.GlobalString("target-database-datasource"),
-				)
+				rules, err := renameRules(c, "rename-rules-file")
 
 				if err != nil {
 					return err
 				}
 
-				buildId := c.GlobalInt64("build-id")
-
-				return migrate.MigrateStages(source, target, buildId)
+				return migrate.ExportK8sSecrets(source, migrate.K8sOptions{
+					Dir:        c.GlobalString("export-dir"),
+					Namespace:  c.GlobalString("k8s-namespace"),
+					Scope:      c.GlobalString("k8s-scope"),
+					NameFormat: c.GlobalString("k8s-name-format"),
+					Registries: c.GlobalBool("k8s-registries"),
+					Rules:      rules,
+				})
 			},
 		},
 		{
-			Name:  "migrate-steps",
-			Usage: "migrate drone steps",
+			Name:  "export-vault",
+			Usage: "export secrets to the vault kv secrets engine",
 			Action: func(c *cli.Context) error {
 				source, err := sql.Open(
 					c.GlobalString("source-database-driver"),
@@ -381,33 +1167,26 @@ func main() {
 					return err
 				}
 
-				target, err := sql.Open(
-					c.GlobalString("target-database-driver"),
-					c.GlobalString("target-database-datasource"),
-				)
+				rules, err := renameRules(c, "rename-rules-file")
 
 				if err != nil {
 					return err
 				}
 
-				buildId := c.GlobalInt64("build-id")
-
-				return migrate.MigrateSteps(source, target, buildId)
+				return migrate.ExportVault(source, migrate.VaultOptions{
+					Addr:   c.GlobalString("vault-addr"),
+					Token:  c.GlobalString("vault-token"),
+					Mount:  c.GlobalString("vault-mount"),
+					Prefix: c.GlobalString("vault-prefix"),
+					Bundle: c.GlobalString("vault-bundle"),
+					Rules:  rules,
+				})
 			},
 		},
 		{
-			Name:  "migrate-logs",
-			Usage: "migrate drone logs",
+			Name:  "promote-org-secrets",
+			Usage: "promote repeated repository secrets to organization secrets",
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
-
-				if err != nil {
-					return err
-				}
-
 				target, err := sql.Open(
 					c.GlobalString("target-database-driver"),
 					c.GlobalString("target-database-datasource"),
@@ -417,68 +1196,49 @@ func main() {
 					return err
 				}
 
-				buildId := c.GlobalInt64("build-id")
-
-				return migrate.MigrateLogs(source, target, buildId)
-			},
-		},
-		{
-			Name:  "migrate-logs-s3",
-			Usage: "migrate drone logs to s3",
-			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
+				key, err := encryptionKey(c, "target-database-encryption-key")
 
 				if err != nil {
 					return err
 				}
 
-				buildId := c.GlobalInt64("build-id")
-				bucket := c.GlobalString("s3-bucket")
-				prefix := c.GlobalString("s3-prefix")
-				return migrate.MigrateLogsS3(source, bucket, prefix, buildId)
+				return migrate.PromoteOrgSecrets(target, key, os.Stdout, migrate.PromoteOptions{
+					MinRepos:          c.GlobalInt("min-repos"),
+					DeleteRepoSecrets: c.GlobalBool("delete-repo-secrets"),
+					DryRun:            c.GlobalBool("dry-run"),
+				})
 			},
 		},
 		{
-			Name:  "migrate-secrets",
-			Usage: "migrate drone secrets",
+			Name:  "activate-repos",
+			Usage: "activate repository resources",
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
 				)
 
 				if err != nil {
 					return err
 				}
 
-				target, err := sql.Open(
-					c.GlobalString("target-database-driver"),
-					c.GlobalString("target-database-datasource"),
-				)
+				collaborators, err := collaboratorFallback(c)
 
 				if err != nil {
 					return err
 				}
 
-				return migrate.MigrateSecrets(source, target)
+				return migrate.ActivateRepositories(
+					target,
+					drone.New(c.GlobalString("drone-server")),
+					collaborators,
+				)
 			},
 		},
 		{
-			Name:  "migrate-registries",
-			Usage: "migrate registry credentials",
+			Name:  "preflight-repos",
+			Usage: "preflight repository activation",
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
-
-				if err != nil {
-					return err
-				}
-
 				target, err := sql.Open(
 					c.GlobalString("target-database-driver"),
 					c.GlobalString("target-database-datasource"),
@@ -488,12 +1248,15 @@ func main() {
 					return err
 				}
 
-				return migrate.MigrateRegistries(source, target)
+				return migrate.ActivateReposPreflight(
+					target,
+					drone.New(c.GlobalString("drone-server")),
+				)
 			},
 		},
 		{
-			Name:  "activate-repos",
-			Usage: "activate repository resources",
+			Name:  "encrypt-secrets",
+			Usage: "encrypt secret in the target database",
 			Action: func(c *cli.Context) error {
 				target, err := sql.Open(
 					c.GlobalString("target-database-driver"),
@@ -504,15 +1267,21 @@ func main() {
 					return err
 				}
 
-				return migrate.ActivateRepositories(
+				key, err := encryptionKey(c, "target-database-encryption-key")
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.EncryptSecrets(
 					target,
-					drone.New(c.GlobalString("drone-server")),
+					key,
 				)
 			},
 		},
 		{
-			Name:  "preflight-repos",
-			Usage: "preflight repository activation",
+			Name:  "decrypt-secrets",
+			Usage: "decrypt secrets in the target database",
 			Action: func(c *cli.Context) error {
 				target, err := sql.Open(
 					c.GlobalString("target-database-driver"),
@@ -523,15 +1292,21 @@ func main() {
 					return err
 				}
 
-				return migrate.ActivateReposPreflight(
+				key, err := encryptionKey(c, "target-database-encryption-key")
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.DecryptSecrets(
 					target,
-					drone.New(c.GlobalString("drone-server")),
+					key,
 				)
 			},
 		},
 		{
-			Name:  "encrypt-secrets",
-			Usage: "encrypt secret in the target database",
+			Name:  "rotate-encryption-key",
+			Usage: "re-encrypt secrets in the target database with a new key",
 			Action: func(c *cli.Context) error {
 				target, err := sql.Open(
 					c.GlobalString("target-database-driver"),
@@ -541,11 +1316,20 @@ func main() {
 				if err != nil {
 					return err
 				}
-				
-				return migrate.EncryptSecrets(
-					target,
-					c.GlobalString("target-database-encryption-key"),
-				)
+
+				oldKey, err := encryptionKey(c, "target-database-old-encryption-key")
+
+				if err != nil {
+					return err
+				}
+
+				key, err := encryptionKey(c, "target-database-encryption-key")
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.RotateEncryptionKey(target, oldKey, key)
 			},
 		},
 		{
@@ -580,6 +1364,36 @@ func setupDriver(driver string) {
 	}
 }
 
+// s3Options is a helper function that returns the s3
+// upload options from the command line flags.
+func s3Options(c *cli.Context) migrate.S3Options {
+	return migrate.S3Options{
+		Bucket:       c.GlobalString("s3-bucket"),
+		Prefix:       c.GlobalString("s3-prefix"),
+		Gzip:         c.GlobalBool("s3-gzip"),
+		Encryption:   c.GlobalString("s3-encryption"),
+		KMSKeyID:     c.GlobalString("s3-kms-key-id"),
+		StorageClass: c.GlobalString("s3-storage-class"),
+		Metadata:     c.GlobalBool("s3-metadata"),
+		Tagging:      c.GlobalBool("s3-tagging"),
+		Resume:       c.GlobalBool("s3-resume"),
+		Verify:       c.GlobalBool("s3-verify"),
+		RetryFile:    c.GlobalString("s3-retry-file"),
+		RetryFrom:    c.GlobalString("s3-retry-from"),
+		Limits:       logLimits(c),
+	}
+}
+
+// logLimits is a helper function that returns the log
+// age and size limits from the command line flags.
+func logLimits(c *cli.Context) migrate.LogLimits {
+	return migrate.LogLimits{
+		MaxAge:   c.GlobalDuration("log-max-age"),
+		MaxSize:  c.GlobalInt64("log-max-size"),
+		KeepTail: c.GlobalBool("log-keep-tail"),
+	}
+}
+
 func createClient(c *cli.Context) (*scm.Client, error) {
 	server := c.GlobalString("scm-server")
 
@@ -632,12 +1446,7 @@ func createClient(c *cli.Context) (*scm.Client, error) {
 		client := bitbucket.NewDefault()
 		client.Client = &http.Client{
 			Transport: &oauth2.Transport{
-				Source: &oauth2.Refresher{
-					ClientID:     c.GlobalString("bitbucket-client-id"),
-					ClientSecret: c.GlobalString("bitbucket-client-secret"),
-					Endpoint:     "https://bitbucket.org/site/oauth2/access_token",
-					Source:       oauth2.ContextTokenSource(),
-				},
+				Source: bitbucketRefresher(c),
 			},
 		}
 
@@ -684,6 +1493,128 @@ func createClient(c *cli.Context) (*scm.Client, error) {
 	}
 }
 
+// bitbucketRefresher is a helper function that returns the
+// bitbucket oauth2 token refresher.
+func bitbucketRefresher(c *cli.Context) *oauth2.Refresher {
+	return &oauth2.Refresher{
+		ClientID:     c.GlobalString("bitbucket-client-id"),
+		ClientSecret: c.GlobalString("bitbucket-client-secret"),
+		Endpoint:     "https://bitbucket.org/site/oauth2/access_token",
+		Source:       oauth2.ContextTokenSource(),
+	}
+}
+
+// tokenOverrides is a helper function that returns the SCM
+// token overrides from the legacy token and orgs flags, the
+// overrides file and the override flags, in that order.
+func tokenOverrides(c *cli.Context) (migrate.TokenOverrides, error) {
+	overrides := migrate.TokenOverrides{}
+
+	if token := c.GlobalString("token"); token != "" {
+		for _, org := range splitList(c.GlobalString("orgs")) {
+			overrides.Set(org, token)
+		}
+	}
+
+	if path := c.GlobalString("token-overrides-file"); path != "" {
+		logrus.Debugf("token overrides file: %s", path)
+
+		if err := overrides.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := overrides.Parse(c.GlobalStringSlice("token-override")); err != nil {
+		return nil, err
+	}
+
+	return overrides, nil
+}
+
+// collaboratorFallback is a helper function that returns the
+// collaborator fallback configuration, or nil if disabled. The
+// 0.x permissions are used if the source database is set.
+func collaboratorFallback(c *cli.Context) (*migrate.Collaborators, error) {
+	if !c.GlobalBool("collaborator-fallback") {
+		return nil, nil
+	}
+
+	collaborators := &migrate.Collaborators{
+		Reassign: c.GlobalBool("reassign-owner"),
+	}
+
+	if c.GlobalString("scm-driver") != "" {
+		client, err := createClient(c)
+
+		if err != nil {
+			return nil, err
+		}
+
+		collaborators.Client = client
+	}
+
+	if datasource := c.GlobalString("source-database-datasource"); datasource != "" {
+		source, err := sql.Open(
+			c.GlobalString("source-database-driver"),
+			datasource,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		collaborators.Source = source
+	}
+
+	return collaborators, nil
+}
+
+// renameRules is a helper function that returns the
+// repository rename rules of the named file flag, or nil if
+// the rules file is not set.
+func renameRules(c *cli.Context, name string) (*migrate.RenameRules, error) {
+	path := c.GlobalString(name)
+	if path == "" {
+		return nil, nil
+	}
+
+	logrus.Debugf("rename rules file: %s", path)
+
+	return migrate.ReadRenameRules(path)
+}
+
+// encryptionKey is a helper function that returns the named
+// encryption key flag, or the contents of the key file if the
+// corresponding file flag is set.
+func encryptionKey(c *cli.Context, name string) (string, error) {
+	path := c.GlobalString(name + "-file")
+	if path == "" {
+		return c.GlobalString(name), nil
+	}
+
+	logrus.Debugf("encryption key file: %s", path)
+
+	d, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(d)), nil
+}
+
+// splitList is a helper function that splits a comma-separated
+// flag value, ignoring empty items.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 // parsePrivateKeyFile is a helper function that parses an
 // RSA Private Key file encoded in PEM format.
 func parsePrivateKeyFile(path string) (*rsa.PrivateKey, error) {
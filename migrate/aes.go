@@ -4,22 +4,61 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"io"
+	"strings"
 )
 
 // indicates key size is too small.
 var errKeySize = errors.New("encryption key must be 32 bytes")
 
-// helper function parses the encryption key.
+// helper function parses the encryption key. The key may be a
+// raw 32 character string, or a base64 or hex encoded 32 byte
+// key with a base64: or hex: prefix.
 func parseKey(key string) (cipher.Block, error) {
-	if len(key) != 32 {
+	b, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
 		return nil, errKeySize
 	}
-	b := []byte(key)
 	return aes.NewCipher(b)
 }
 
+// helper function decodes the base64: or hex: prefixed key.
+func decodeKey(key string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(key, "base64:"):
+		return base64.StdEncoding.DecodeString(strings.TrimPrefix(key, "base64:"))
+	case strings.HasPrefix(key, "hex:"):
+		return hex.DecodeString(strings.TrimPrefix(key, "hex:"))
+	default:
+		return []byte(key), nil
+	}
+}
+
+// helper function returns a fingerprint of the key that can
+// be logged to confirm two systems use the same key without
+// revealing the key.
+func fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// helper function returns the fingerprint of the encoded
+// key, or an empty string if the key cannot be decoded.
+func keyFingerprint(key string) string {
+	b, err := decodeKey(key)
+	if err != nil {
+		return ""
+	}
+	return fingerprint(b)
+}
+
 // helper function to encrypt secrets.
 func encrypt(block cipher.Block, plaintext string) ([]byte, error) {
 	gcm, err := cipher.NewGCM(block)
@@ -35,3 +74,55 @@ func encrypt(block cipher.Block, plaintext string) ([]byte, error) {
 
 	return gcm.Seal(nonce, nonce, []byte(plaintext), nil), nil
 }
+
+// helper function to decrypt secrets.
+func decrypt(block cipher.Block, ciphertext []byte) (string, error) {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return "", errors.New("malformed ciphertext")
+	}
+
+	plaintext, err := gcm.Open(nil,
+		ciphertext[:gcm.NonceSize()],
+		ciphertext[gcm.NonceSize():],
+		nil,
+	)
+	return string(plaintext), err
+}
+
+// helper function parses the optional encryption key. A nil
+// block is returned if the key is empty.
+func parseOptionalKey(key string) (cipher.Block, error) {
+	if key == "" {
+		return nil, nil
+	}
+	return parseKey(key)
+}
+
+// helper function returns the secret data as it should be
+// stored in the database, encrypted if a key is provided.
+func seal(block cipher.Block, plaintext string) (string, error) {
+	if block == nil {
+		return plaintext, nil
+	}
+	ciphertext, err := encrypt(block, plaintext)
+	return string(ciphertext), err
+}
+
+// helper function returns the plaintext secret data stored
+// in the database. If the data cannot be decrypted with the
+// key it is assumed to be plaintext.
+func unseal(block cipher.Block, data string) string {
+	if block == nil {
+		return data
+	}
+	plaintext, err := decrypt(block, []byte(data))
+	if err != nil {
+		return data
+	}
+	return plaintext
+}
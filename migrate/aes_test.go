@@ -0,0 +1,65 @@
+package migrate
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodeKey(t *testing.T) {
+	raw := "fd0e807c2e6a4b0c9a1d5e3f7b8a9c0d"
+
+	tests := []struct {
+		key  string
+		want []byte
+		err  bool
+	}{
+		{key: raw, want: []byte(raw)},
+		{key: "base64:ZmQwZTgwN2MyZTZhNGIwYzlhMWQ1ZTNmN2I4YTljMGQ=", want: []byte(raw)},
+		{key: "hex:6664306538303763326536613462306339613164356533663762386139633064", want: []byte(raw)},
+		{key: "base64:not base64", err: true},
+		{key: "hex:zz", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := decodeKey(test.key)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: want error", test.key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.key, err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: want %q, got %q", test.key, test.want, got)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	if _, err := parseKey("too short"); err != errKeySize {
+		t.Errorf("want key size error, got %v", err)
+	}
+
+	block, err := parseKey("hex:6664306538303763326536613462306339613164356533663762386139633064")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := seal(block, "correct-horse-battery-staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := unseal(block, data); got != "correct-horse-battery-staple" {
+		t.Errorf("want sealed secret to unseal, got %q", got)
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	raw := keyFingerprint("fd0e807c2e6a4b0c9a1d5e3f7b8a9c0d")
+	encoded := keyFingerprint("base64:ZmQwZTgwN2MyZTZhNGIwYzlhMWQ1ZTNmN2I4YTljMGQ=")
+	if raw == "" || raw != encoded {
+		t.Errorf("want the same fingerprint for encoded keys, got %q and %q", raw, encoded)
+	}
+}
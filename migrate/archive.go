@@ -0,0 +1,266 @@
+package migrate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// ArchiveStore stores build log archives.
+type ArchiveStore interface {
+	// Put writes the archive to the named key.
+	Put(key string, data []byte) error
+}
+
+// NewArchiveDir returns an ArchiveStore that writes the
+// archives to a local directory.
+func NewArchiveDir(dir string) ArchiveStore {
+	return &dirStore{dir: dir}
+}
+
+// NewArchiveS3 returns an ArchiveStore that uploads the
+// archives to an s3 bucket, or an error if the s3 options
+// are invalid.
+func NewArchiveS3(opts S3Options) (ArchiveStore, error) {
+	if opts.Bucket == "" {
+		return nil, errors.New("the s3 bucket is required")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	sess := session.Must(
+		session.NewSession(&aws.Config{}),
+	)
+	return &s3Store{
+		uploader: s3manager.NewUploader(sess),
+		opts:     opts,
+	}, nil
+}
+
+type dirStore struct {
+	dir string
+}
+
+func (s *dirStore) Put(key string, data []byte) error {
+	name := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, data, 0644)
+}
+
+type s3Store struct {
+	uploader *s3manager.Uploader
+	opts     S3Options
+}
+
+func (s *s3Store) Put(key string, data []byte) error {
+	input := &s3manager.UploadInput{
+		ACL:         aws.String("private"),
+		Bucket:      aws.String(s.opts.Bucket),
+		Key:         aws.String(path.Join("/", s.opts.Prefix, key)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/gzip"),
+	}
+	if s.opts.Encryption != "" {
+		input.ServerSideEncryption = aws.String(s.opts.Encryption)
+	}
+	if s.opts.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.opts.KMSKeyID)
+	}
+	if s.opts.StorageClass != "" {
+		input.StorageClass = aws.String(s.opts.StorageClass)
+	}
+	_, err := s.uploader.Upload(input)
+	return err
+}
+
+// archiveManifest is the build metadata included in each
+// build log archive.
+type archiveManifest struct {
+	Repo  string            `json:"repo"`
+	Build *BuildV0          `json:"build"`
+	Steps []*StepV0         `json:"steps"`
+	Files map[string]string `json:"files"`
+}
+
+// ExportLogs exports the build logs from the V0 database
+// as one gzip compressed tar archive per build, named
+// <namespace>/<repo>/<build-number>.tar.gz.
+func ExportLogs(source *sql.DB, store ArchiveStore, buildId int64) error {
+	reposV0 := []*RepoV0{}
+	if err := meddler.QueryAll(source, &reposV0, "select * from repos"); err != nil {
+		return err
+	}
+
+	repos := map[int64]*RepoV0{}
+	for _, repoV0 := range reposV0 {
+		repos[repoV0.ID] = repoV0
+	}
+
+	buildsV0 := []*BuildV0{}
+	if err := meddler.QueryAll(source, &buildsV0, buildExportQuery, buildId); err != nil {
+		return err
+	}
+
+	logrus.Infof("exporting logs for %d builds", len(buildsV0))
+
+	keys := map[string]bool{}
+	for i, buildV0 := range buildsV0 {
+		repoV0, ok := repos[buildV0.RepoID]
+		if !ok {
+			logrus.Warnf("cannot find repository for build: id: %d", buildV0.ID)
+			continue
+		}
+
+		log := logrus.
+			WithField("repository", repoV0.FullName).
+			WithField("build", buildV0.Number)
+		log.Debugln("export build logs")
+
+		data, err := archiveBuild(source, repoV0, buildV0)
+		if err != nil {
+			log.WithError(err).Errorln("export failed")
+			return err
+		}
+
+		// the 0.x database may contain duplicate build
+		// numbers for a repository, in which case the build
+		// id is appended to avoid overwriting the archive.
+		key := fmt.Sprintf("%s/%s/%d.tar.gz", repoV0.Owner, repoV0.Name, buildV0.Number)
+		if keys[key] {
+			log.Warnf("duplicate build number, exporting as build id: %d", buildV0.ID)
+			key = fmt.Sprintf("%s/%s/%d-%d.tar.gz", repoV0.Owner, repoV0.Name, buildV0.Number, buildV0.ID)
+		}
+		keys[key] = true
+
+		if err := store.Put(key, data); err != nil {
+			log.WithError(err).Errorln("export failed")
+			return err
+		}
+
+		if i%1000 == 0 {
+			logrus.Infof("exported: %d", buildV0.ID)
+		}
+	}
+
+	logrus.Infof("export complete")
+	return nil
+}
+
+// helper function creates the gzip compressed tar archive
+// for the build, with one file per step and a manifest.
+func archiveBuild(source *sql.DB, repoV0 *RepoV0, buildV0 *BuildV0) ([]byte, error) {
+	stepsV0 := []*StepV0{}
+	err := meddler.QueryAll(source, &stepsV0, stepExportQuery, buildV0.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &archiveManifest{
+		Repo:  repoV0.FullName,
+		Build: buildV0,
+		Steps: stepsV0,
+		Files: map[string]string{},
+	}
+
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	modified := time.Unix(buildV0.Finished, 0)
+
+	for _, stepV0 := range stepsV0 {
+		logsV0 := &LogsV0{}
+		err := meddler.QueryRow(source, logsV0, fmt.Sprintf("select * from logs where log_job_id = %d", stepV0.ID))
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			logrus.WithError(err).Warnf("cannot find logs for step: id: %d", stepV0.ID)
+			continue
+		}
+
+		name := archiveFileName(stepV0)
+		if _, ok := manifest.Files[name]; ok {
+			name = fmt.Sprintf("%s-%d", name, stepV0.PID)
+		}
+		manifest.Files[name] = stepV0.Name
+
+		if err := writeTarFile(tw, name, logsV0.Data, modified); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, "manifest.json", data, modified); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// helper function returns the archive file name for the
+// step, which is the step name with path separators
+// removed.
+func archiveFileName(stepV0 *StepV0) string {
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(stepV0.Name)
+	if name == "" || name == "." || name == ".." || name == "manifest.json" {
+		name = fmt.Sprintf("step-%d", stepV0.PID)
+	}
+	return name
+}
+
+// helper function writes a file to the tar archive.
+func writeTarFile(tw *tar.Writer, name string, data []byte, modified time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modified,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+const buildExportQuery = `
+SELECT builds.*
+FROM builds
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE builds.build_id > ?
+ORDER BY build_id ASC
+`
+
+const stepExportQuery = `
+SELECT *
+FROM procs
+WHERE proc_build_id = ?
+  AND proc_ppid != 0
+ORDER BY proc_id ASC
+`
@@ -0,0 +1,238 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/go-scm/scm"
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// Collaborators configures the fallback to other users with
+// push or admin access to a repository when the repository
+// owner token fails.
+type Collaborators struct {
+	// Source is the 0.x database, used to find users with
+	// access in the 0.x permissions (optional).
+	Source *sql.DB
+
+	// Reassign updates the repository owner to the first
+	// collaborator whose token works.
+	Reassign bool
+
+	// Client is the source code management client, used to
+	// confirm a collaborator has admin access before the
+	// repository is activated with the collaborator account.
+	Client *scm.Client
+}
+
+// helper function returns the users, other than the owner,
+// with push or admin access to the repository in the 0.x or
+// 1.x permissions, with admins first.
+func (c *Collaborators) find(db *sql.DB, repo *RepoV1) ([]*UserV1, error) {
+	admin := map[int64]bool{}
+
+	query := permV1ListQuery
+	if meddler.Default == meddler.PostgreSQL {
+		query = permV1ListQueryPostgres
+	}
+
+	permsV1 := []*PermV1{}
+	if err := meddler.QueryAll(db, &permsV1, query, repo.UID); err != nil {
+		return nil, err
+	}
+	for _, perm := range permsV1 {
+		if perm.Write || perm.Admin {
+			admin[perm.UserID] = admin[perm.UserID] || perm.Admin
+		}
+	}
+
+	// the repository and user identifiers are preserved
+	// by the migration, so the 0.x permissions can be
+	// matched directly.
+	if c.Source != nil {
+		permsV0 := []*PermV0{}
+		if err := meddler.QueryAll(c.Source, &permsV0, fmt.Sprintf(permV0ListQuery, repo.ID)); err != nil {
+			return nil, err
+		}
+		for _, perm := range permsV0 {
+			if perm.Push || perm.Admin {
+				admin[perm.UserID] = admin[perm.UserID] || perm.Admin
+			}
+		}
+	}
+
+	var users []*UserV1
+	for id := range admin {
+		if id == repo.UserID {
+			continue
+		}
+		user := &UserV1{}
+		err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, id))
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if user.Machine || !user.Active || user.Token == "" {
+			continue
+		}
+		users = append(users, user)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		if admin[users[i].ID] != admin[users[j].ID] {
+			return admin[users[i].ID]
+		}
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+// helper function finds the remote repository with the owner
+// or override token, falling back to the collaborator tokens.
+// It returns the collaborator if the fallback was used.
+func findRemoteRepo(db *sql.DB, client *scm.Client, overrides TokenOverrides, collaborators *Collaborators, repo *RepoV1) (*scm.Repository, *UserV1, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"repo": repo.Slug,
+	})
+
+	tok, owner, err := findRepoToken(db, overrides, repo)
+	if err == nil {
+		log = log.WithField("owner", owner)
+		ctx := scm.WithContext(context.Background(), tok)
+		remoteRepo, _, err := client.Repositories.Find(ctx, scm.Join(repo.Namespace, repo.Name))
+		if err == nil {
+			return remoteRepo, nil, nil
+		}
+		if collaborators == nil {
+			return nil, nil, err
+		}
+		log.WithError(err).Warnln("failed to get remote repository, trying collaborators")
+	} else if collaborators == nil {
+		return nil, nil, err
+	} else {
+		log.WithError(err).Warnln("failed to get repository owner, trying collaborators")
+	}
+
+	users, err := collaborators.find(db, repo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lastErr := fmt.Errorf("no collaborator with push access")
+	for _, user := range users {
+		ctx := scm.WithContext(context.Background(), userToken(user))
+		remoteRepo, _, err := client.Repositories.Find(ctx, scm.Join(repo.Namespace, repo.Name))
+		if err != nil {
+			log.WithError(err).WithField("collaborator", user.Login).Debugln("failed to get remote repository")
+			lastErr = err
+			continue
+		}
+		log.WithField("collaborator", user.Login).Infoln("found remote repository with collaborator token")
+		return remoteRepo, user, nil
+	}
+	return nil, nil, lastErr
+}
+
+// helper function activates the repository with the
+// collaborator account. The collaborator permissions are only
+// written once the source code management system confirms the
+// collaborator has admin access, and are removed again if the
+// activation fails.
+func (c *Collaborators) activate(db *sql.DB, client drone.Client, repo *RepoV1, user *UserV1) error {
+	log := logrus.WithFields(logrus.Fields{
+		"repo":         repo.Slug,
+		"collaborator": user.Login,
+	})
+
+	if c.Client == nil {
+		return fmt.Errorf("the scm driver is required to confirm collaborator access")
+	}
+
+	ctx := scm.WithContext(context.Background(), userToken(user))
+	remoteRepo, _, err := c.Client.Repositories.Find(ctx, scm.Join(repo.Namespace, repo.Name))
+	if err != nil {
+		return err
+	}
+	if remoteRepo.Perm == nil || !remoteRepo.Perm.Admin {
+		return fmt.Errorf("collaborator does not have admin access")
+	}
+
+	permV1 := &PermV1{
+		UserID:  user.ID,
+		RepoUID: repo.UID,
+		Read:    remoteRepo.Perm.Pull,
+		Write:   remoteRepo.Perm.Push,
+		Admin:   remoteRepo.Perm.Admin,
+		Synced:  time.Now().Unix(),
+		Created: time.Now().Unix(),
+		Updated: time.Now().Unix(),
+	}
+	inserted := true
+	if err := meddler.Insert(db, "perms", permV1); err != nil {
+		log.WithError(err).Debugln("cannot insert permissions. permissions may already exist.")
+		inserted = false
+	}
+
+	query := permDeleteQuery
+	if meddler.Default == meddler.PostgreSQL {
+		query = permDeleteQueryPostgres
+	}
+
+	err = postRepo(client, repo, user)
+	if err != nil && inserted {
+		if _, derr := db.Exec(query, user.ID, repo.UID); derr != nil {
+			log.WithError(derr).Errorln("failed to remove collaborator permissions")
+		}
+	}
+	return err
+}
+
+// helper function updates the repository owner.
+func reassignOwner(db *sql.DB, repo *RepoV1, user *UserV1) error {
+	_, err := db.Exec(fmt.Sprintf(repoOwnerUpdateQuery, user.ID, repo.ID))
+	return err
+}
+
+const permV0ListQuery = `
+SELECT *
+FROM perms
+WHERE perm_repo_id = %d
+`
+
+const permV1ListQuery = `
+SELECT *
+FROM perms
+WHERE perm_repo_uid = ?
+`
+
+const permV1ListQueryPostgres = `
+SELECT *
+FROM perms
+WHERE perm_repo_uid = $1
+`
+
+const permDeleteQuery = `
+DELETE FROM perms
+WHERE perm_user_id = ?
+  AND perm_repo_uid = ?
+`
+
+const permDeleteQueryPostgres = `
+DELETE FROM perms
+WHERE perm_user_id = $1
+  AND perm_repo_uid = $2
+`
+
+const repoOwnerUpdateQuery = `
+UPDATE repos
+SET repo_user_id = %d
+WHERE repo_id = %d
+`
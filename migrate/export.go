@@ -0,0 +1,434 @@
+package migrate
+
+import (
+	"bytes"
+	"crypto/aes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// ExportEncryptedSecrets exports the secrets from the V0
+// database as 1.x encrypted secret yaml documents, one file
+// per repository named <dir>/<namespace>/<name>.yml. The
+// secrets are encrypted with the secret key of the migrated
+// V1 repository, compatible with the drone encrypt command.
+func ExportEncryptedSecrets(source, target *sql.DB, dir string) error {
+	secretsV0, err := listRepoSecretsV0(source)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("exporting %d secrets", len(secretsV0))
+
+	// group the secrets by repository, preserving the
+	// order of the query which is sorted by name.
+	var repoIDs []int64
+	secrets := map[int64][]*repoSecretV0{}
+	for _, secretV0 := range secretsV0 {
+		if _, ok := secrets[secretV0.RepoID]; !ok {
+			repoIDs = append(repoIDs, secretV0.RepoID)
+		}
+		secrets[secretV0.RepoID] = append(secrets[secretV0.RepoID], secretV0)
+	}
+
+	for _, repoID := range repoIDs {
+		log := logrus.WithFields(logrus.Fields{
+			"repo": secrets[repoID][0].RepoFullname,
+		})
+
+		repoV1 := &RepoV1{}
+		if err := meddler.QueryRow(target, repoV1, fmt.Sprintf(repoIdentifierQuery, repoID)); err != nil {
+			log.WithError(err).Errorln("failed to get migrated repository")
+			continue
+		}
+
+		block, err := aes.NewCipher([]byte(repoV1.Secret))
+		if err != nil {
+			log.WithError(err).Errorln("cannot read repository secret key")
+			continue
+		}
+
+		buf := new(bytes.Buffer)
+		for _, secretV0 := range secrets[repoID] {
+			ciphertext, err := encrypt(block, secretV0.Value)
+			if err != nil {
+				log.WithError(err).Errorln("encryption failed")
+				return err
+			}
+			fmt.Fprintf(buf, "---\n")
+			fmt.Fprintf(buf, "kind: secret\n")
+			fmt.Fprintf(buf, "name: %s\n", strconv.Quote(secretV0.Name))
+			fmt.Fprintf(buf, "data: %s\n\n", base64.StdEncoding.EncodeToString(ciphertext))
+		}
+
+		name := filepath.Join(dir, repoV1.Namespace, repoV1.Name+".yml")
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(name, buf.Bytes(), 0600); err != nil {
+			log.WithError(err).Errorln("export failed")
+			return err
+		}
+
+		log.Debugln("export complete")
+	}
+
+	logrus.Infof("export complete")
+	return nil
+}
+
+// K8sOptions configures the export of Kubernetes secrets.
+type K8sOptions struct {
+	// Dir is the directory the manifests are written to.
+	Dir string
+
+	// Namespace is the Kubernetes namespace of the secrets.
+	Namespace string
+
+	// Scope is repo to create one Kubernetes secret per
+	// repository, or namespace to create one per namespace.
+	Scope string
+
+	// NameFormat is the text/template used to name the
+	// Kubernetes secrets, with the .Namespace, .Name and
+	// .Slug of the repository (optional).
+	NameFormat string
+
+	// Registries exports registry credentials as
+	// kubernetes.io/dockerconfigjson secrets.
+	Registries bool
+
+	// Rules are the repository rename rules, applied to the
+	// repository names the secrets are scoped to (optional).
+	Rules *RenameRules
+}
+
+// k8sSecret is a Kubernetes secret manifest.
+type k8sSecret struct {
+	Name        string
+	Type        string
+	Annotations map[string]string
+	Data        map[string]string
+
+	// owner is the repository slug, or the namespace, the
+	// secret name was generated for.
+	owner string
+}
+
+// k8sRef is the location of a secret value in Kubernetes,
+// referenced by the pipeline using get: path and name.
+type k8sRef struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+}
+
+// ExportK8sSecrets exports the secrets, and optionally the
+// registry credentials, from the V0 database as Kubernetes
+// secret manifests for use with the kubernetes-secrets
+// extension. A mapping.json file is written with the get
+// path and name that pipelines must reference for each
+// repository secret.
+func ExportK8sSecrets(source *sql.DB, opts K8sOptions) error {
+	switch opts.Scope {
+	case "", "repo", "namespace":
+	default:
+		return fmt.Errorf("unknown kubernetes secret scope: %s", opts.Scope)
+	}
+
+	format := opts.NameFormat
+	if format == "" && opts.Scope == "namespace" {
+		format = "drone-{{ .Namespace }}"
+	} else if format == "" {
+		format = "drone-{{ .Namespace }}-{{ .Name }}"
+	}
+	tmpl, err := template.New("name").Parse(format)
+	if err != nil {
+		logrus.WithError(err).Errorln("cannot parse secret name format")
+		return err
+	}
+
+	secretsV0, err := listRepoSecretsV0(source)
+	if err != nil {
+		return err
+	}
+
+	registriesV0 := []*RegistryV0{}
+	if opts.Registries {
+		if err := meddler.QueryAll(source, &registriesV0, registryImportQuery); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("exporting %d secrets and %d registries", len(secretsV0), len(registriesV0))
+
+	var names []string
+	manifests := map[string]*k8sSecret{}
+	mapping := map[string]map[string]k8sRef{}
+
+	// the extension restricts every secret in a manifest to
+	// the same events, so secrets with different events are
+	// written to separate manifests, named by their events.
+	nameEvents := map[string]string{}
+
+	// helper function returns the manifest for the repository,
+	// creating it if it does not exist. The manifest is
+	// restricted to the events with the X-Drone-Events
+	// annotation used by the kubernetes-secrets extension. The
+	// repositories are added to the X-Drone-Repos annotation
+	// once their secret is written to the manifest.
+	manifest := func(slug, suffix, kind string, events []string) (*k8sSecret, error) {
+		name, err := k8sSecretName(tmpl, slug, opts.Scope)
+		if err != nil {
+			return nil, err
+		}
+		name = k8sName(name + suffix)
+
+		owner := slug
+		if opts.Scope == "namespace" {
+			owner = strings.SplitN(slug, "/", 2)[0]
+		}
+		eventList := strings.Join(events, ",")
+		if first, ok := nameEvents[name]; !ok {
+			nameEvents[name] = eventList
+		} else if first != eventList {
+			if m := manifests[name]; m.owner != owner {
+				return nil, fmt.Errorf("kubernetes secret %s is used by %s and %s, use a different name format", name, m.owner, owner)
+			}
+			name = k8sName(name + "-" + strings.Join(events, "-"))
+		}
+
+		m, ok := manifests[name]
+		if ok && m.owner != owner {
+			return nil, fmt.Errorf("kubernetes secret %s is used by %s and %s, use a different name format", name, m.owner, owner)
+		}
+		if !ok {
+			m = &k8sSecret{
+				Name:        name,
+				Type:        kind,
+				Annotations: map[string]string{},
+				Data:        map[string]string{},
+				owner:       owner,
+			}
+			if len(events) != 0 {
+				m.Annotations["X-Drone-Events"] = eventList
+			}
+			manifests[name] = m
+			names = append(names, name)
+		}
+		return m, nil
+	}
+
+	for _, secretV0 := range secretsV0 {
+		slug := opts.Rules.Slug(secretV0.RepoFullname)
+		log := logrus.WithFields(logrus.Fields{
+			"repo":   slug,
+			"secret": secretV0.Name,
+		})
+
+		m, err := manifest(slug, "", "Opaque", secretEvents(secretV0.Events))
+		if err != nil {
+			log.WithError(err).Errorln("cannot create secret name")
+			return err
+		}
+
+		key := k8sKey(secretV0.Name)
+		value := base64.StdEncoding.EncodeToString([]byte(secretV0.Value))
+		if existing, ok := m.Data[key]; ok && existing != value {
+			log.Warnf("skipping secret, conflicts with another repository in kubernetes secret %s", m.Name)
+			continue
+		}
+		m.Data[key] = value
+		m.Annotations["X-Drone-Repos"] = appendList(m.Annotations["X-Drone-Repos"], slug)
+
+		if mapping[slug] == nil {
+			mapping[slug] = map[string]k8sRef{}
+		}
+		mapping[slug][secretV0.Name] = k8sRef{Path: m.Name, Name: key}
+	}
+
+	if opts.Registries {
+		configs := groupRegistries(registriesV0)
+		var slugs []string
+		for slug := range configs {
+			slugs = append(slugs, slug)
+		}
+		sort.Strings(slugs)
+
+		for _, repoFullname := range slugs {
+			config := configs[repoFullname]
+			slug := opts.Rules.Slug(repoFullname)
+			log := logrus.WithFields(logrus.Fields{
+				"repo": slug,
+			})
+
+			m, err := manifest(slug, "-registry", "kubernetes.io/dockerconfigjson", nil)
+			if err != nil {
+				log.WithError(err).Errorln("cannot create secret name")
+				return err
+			}
+
+			// merge the credentials of all repositories that
+			// share the kubernetes secret.
+			merged := DockerConfig{AuthConfigs: map[string]AuthConfig{}}
+			if existing, ok := m.Data[".dockerconfigjson"]; ok {
+				decoded, _ := base64.StdEncoding.DecodeString(existing)
+				json.Unmarshal(decoded, &merged)
+			}
+			for addr, auth := range config.AuthConfigs {
+				merged.AuthConfigs[addr] = auth
+			}
+			data, err := json.Marshal(merged)
+			if err != nil {
+				log.WithError(err).Errorln("failed to build docker config")
+				return err
+			}
+			m.Data[".dockerconfigjson"] = base64.StdEncoding.EncodeToString(data)
+			m.Annotations["X-Drone-Repos"] = appendList(m.Annotations["X-Drone-Repos"], slug)
+
+			if mapping[slug] == nil {
+				mapping[slug] = map[string]k8sRef{}
+			}
+			mapping[slug][".dockerconfigjson"] = k8sRef{Path: m.Name, Name: ".dockerconfigjson"}
+		}
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return err
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		data := writeK8sSecret(manifests[name], opts.Namespace)
+		if err := ioutil.WriteFile(filepath.Join(opts.Dir, name+".yml"), data, 0600); err != nil {
+			logrus.WithError(err).Errorln("export failed")
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(opts.Dir, "mapping.json"), data, 0644); err != nil {
+		logrus.WithError(err).Errorln("export failed")
+		return err
+	}
+
+	logrus.Infof("exported %d kubernetes secrets", len(names))
+	return nil
+}
+
+// helper function returns the sorted events the 0.x secret
+// is exposed to, which are the default events if no events
+// are configured.
+func secretEvents(events []string) []string {
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+	sorted := append([]string(nil), events...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// helper function returns the kubernetes secret name for the
+// repository, using the name template.
+func k8sSecretName(tmpl *template.Template, slug, scope string) (string, error) {
+	parts := strings.SplitN(slug, "/", 2)
+	data := struct {
+		Namespace string
+		Name      string
+		Slug      string
+	}{
+		Namespace: parts[0],
+		Slug:      slug,
+	}
+	if len(parts) == 2 && scope != "namespace" {
+		data.Name = parts[1]
+	}
+	buf := new(bytes.Buffer)
+	err := tmpl.Execute(buf, data)
+	return buf.String(), err
+}
+
+// helper function converts the string to a valid kubernetes
+// resource name, which must be a lowercase dns subdomain.
+func k8sName(s string) string {
+	name := strings.Trim(invalidK8sName.ReplaceAllString(strings.ToLower(s), "-"), "-.")
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return name
+}
+
+// helper function converts the string to a valid kubernetes
+// secret data key.
+func k8sKey(s string) string {
+	return invalidK8sKey.ReplaceAllString(s, "_")
+}
+
+// helper function writes the kubernetes secret manifest.
+func writeK8sSecret(m *k8sSecret, namespace string) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "apiVersion: v1\n")
+	fmt.Fprintf(buf, "kind: Secret\n")
+	fmt.Fprintf(buf, "metadata:\n")
+	fmt.Fprintf(buf, "  name: %s\n", m.Name)
+	if namespace != "" {
+		fmt.Fprintf(buf, "  namespace: %s\n", namespace)
+	}
+	fmt.Fprintf(buf, "  annotations:\n")
+	for _, key := range sortedKeys(m.Annotations) {
+		fmt.Fprintf(buf, "    %s: %s\n", key, strconv.Quote(m.Annotations[key]))
+	}
+	fmt.Fprintf(buf, "type: %s\n", m.Type)
+	fmt.Fprintf(buf, "data:\n")
+	for _, key := range sortedKeys(m.Data) {
+		fmt.Fprintf(buf, "  %s: %s\n", strconv.Quote(key), m.Data[key])
+	}
+	return buf.Bytes()
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// helper function appends the item to the comma separated
+// list if it does not already contain the item.
+func appendList(list, item string) string {
+	if list == "" {
+		return item
+	}
+	if contains(strings.Split(list, ","), item) {
+		return list
+	}
+	return list + "," + item
+}
+
+var (
+	invalidK8sName = regexp.MustCompile(`[^a-z0-9.-]+`)
+	invalidK8sKey  = regexp.MustCompile(`[^-._a-zA-Z0-9]+`)
+)
+
+const repoIdentifierQuery = `
+SELECT *
+FROM repos
+WHERE repo_id = %d
+`
@@ -0,0 +1,197 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// HostOptions configures the move of the repositories to a
+// different source code management system host.
+type HostOptions struct {
+	// OldURL and NewURL are the web base urls of the old and
+	// new source code management system, for example
+	// https://github.com and https://github.company.com.
+	OldURL string
+	NewURL string
+
+	// Rules are the namespace and repository rename rules
+	// applied during the move (optional).
+	Rules *RenameRules
+
+	// DryRun prints the report without making changes.
+	DryRun bool
+}
+
+// MigrateSCMHost rewrites the repository clone and web urls
+// and the build links from the old to the new source code
+// management system host, applying the rename rules. The
+// repository identifiers are reset to temporary values so
+// they are fetched from the new host by UpdateRepoIdentifiers.
+// The changes are written to w.
+func MigrateSCMHost(db *sql.DB, w io.Writer, opts HostOptions) error {
+	oldURL := strings.TrimSuffix(opts.OldURL, "/")
+	newURL := strings.TrimSuffix(opts.NewURL, "/")
+	if oldURL == "" || newURL == "" {
+		return fmt.Errorf("the old and new scm host urls are required")
+	}
+
+	repos := []*RepoV1{}
+	if err := meddler.QueryAll(db, &repos, repoActivateQuery); err != nil {
+		return err
+	}
+
+	logrus.Infof("moving %d repositories from %s to %s", len(repos), oldURL, newURL)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	collisionQuery := repoCollisionQuery
+	permQuery := permRepoDeleteQuery
+	linkQuery := buildLinkUpdateQuery
+	if meddler.Default == meddler.PostgreSQL {
+		collisionQuery = repoCollisionQueryPostgres
+		permQuery = permRepoDeleteQueryPostgres
+		linkQuery = buildLinkUpdateQueryPostgres
+	}
+
+	var moved, skipped int
+	for _, repo := range repos {
+		log := logrus.WithFields(logrus.Fields{
+			"repo": repo.Slug,
+		})
+
+		oldSlug := repo.Slug
+		if !strings.HasPrefix(repo.Link, oldURL+"/") && !strings.HasPrefix(repo.HTTPURL, oldURL+"/") {
+			fmt.Fprintf(w, "%s: skipped, not hosted on %s\n", oldSlug, oldURL)
+			skipped++
+			continue
+		}
+
+		namespace, name := opts.Rules.Rename(repo.Namespace, repo.Name)
+		newSlug := namespace + "/" + name
+
+		if newSlug != oldSlug {
+			existing := &RepoV1{}
+			err := meddler.QueryRow(tx, existing, collisionQuery, newSlug, repo.ID)
+			if err == nil {
+				fmt.Fprintf(w, "%s: skipped, %s collides with repository id %d\n", oldSlug, newSlug, existing.ID)
+				skipped++
+				continue
+			}
+			if err != sql.ErrNoRows {
+				log.WithError(err).Errorln("failed to query for existing repository")
+				return err
+			}
+		}
+
+		// the repository path in the web url is replaced
+		// first, which includes the clone url and the build
+		// links, so the new namespace and name are applied.
+		// The link is used because the path can differ from
+		// the slug if the repository was renamed.
+		oldPrefix := oldURL + "/" + oldSlug
+		if strings.HasPrefix(repo.Link, oldURL+"/") {
+			oldPrefix = repo.Link
+		}
+		newPrefix := newURL + "/" + newSlug
+		oldLink := repo.Link
+
+		repo.Namespace = namespace
+		repo.Name = name
+		repo.Slug = newSlug
+		repo.HTTPURL = rewriteURL(repo.HTTPURL, oldURL, newURL, oldPrefix, newPrefix)
+		repo.Link = rewriteURL(repo.Link, oldURL, newURL, oldPrefix, newPrefix)
+		repo.UID = fmt.Sprintf("temp_%d", repo.ID)
+		// the ssh url cannot be derived from the web url and
+		// is updated from the new host with the metadata.
+		repo.SSHURL = ""
+		repo.Updated = time.Now().Unix()
+
+		fmt.Fprintf(w, "%s: %s -> %s\n", oldSlug, oldLink, repo.Link)
+		moved++
+
+		if opts.DryRun {
+			continue
+		}
+
+		// the permissions reference the repository identifier
+		// of the old host, and are synced again when the users
+		// log in to the new host.
+		var uid string
+		if err := tx.QueryRow(fmt.Sprintf(repoUIDQuery, repo.ID)).Scan(&uid); err != nil {
+			log.WithError(err).Errorln("failed to get repository identifier")
+			return err
+		}
+		if _, err := tx.Exec(permQuery, uid); err != nil {
+			log.WithError(err).Errorln("failed to remove repository permissions")
+			return err
+		}
+
+		if err := meddler.Update(tx, "repos", (*RepoV1Update)(repo)); err != nil {
+			log.WithError(err).Errorln("failed to update repository")
+			return err
+		}
+
+		// the links are compared by prefix instead of LIKE,
+		// because the url can contain wildcard characters.
+		prefix := oldPrefix + "/"
+		if _, err := tx.Exec(linkQuery, prefix, newPrefix+"/", repo.ID, utf8.RuneCountInString(prefix), prefix); err != nil {
+			log.WithError(err).Errorln("failed to update build links")
+			return err
+		}
+
+		log.Debugln("moved repository")
+	}
+
+	if opts.DryRun {
+		logrus.Infof("dry run: %d repositories can be moved, %d skipped", moved, skipped)
+		return nil
+	}
+
+	logrus.Infof("moved %d repositories, %d skipped", moved, skipped)
+	return tx.Commit()
+}
+
+// helper function rewrites the url from the old to the new
+// host, replacing the repository path if the url starts with
+// the old repository prefix.
+func rewriteURL(u, oldURL, newURL, oldPrefix, newPrefix string) string {
+	switch {
+	case strings.HasPrefix(u, oldPrefix):
+		return newPrefix + strings.TrimPrefix(u, oldPrefix)
+	case strings.HasPrefix(u, oldURL):
+		return newURL + strings.TrimPrefix(u, oldURL)
+	default:
+		return u
+	}
+}
+
+const repoUIDQuery = `
+SELECT repo_uid
+FROM repos
+WHERE repo_id = %d
+`
+
+const buildLinkUpdateQuery = `
+UPDATE builds
+SET build_link = REPLACE(build_link, ?, ?)
+WHERE build_repo_id = ?
+  AND SUBSTR(build_link, 1, ?) = ?
+`
+
+const buildLinkUpdateQueryPostgres = `
+UPDATE builds
+SET build_link = REPLACE(build_link, $1, $2)
+WHERE build_repo_id = $3
+  AND SUBSTR(build_link, 1, $4) = $5
+`
@@ -1,13 +1,28 @@
 package migrate
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/md5"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/russross/meddler"
 	"github.com/sirupsen/logrus"
@@ -15,7 +30,12 @@ import (
 
 // MigrateLogs migrates the steps from the V0
 // database to the V1 database.
-func MigrateLogs(source, target *sql.DB, buildId int64) error {
+func MigrateLogs(source, target *sql.DB, buildId int64, limits LogLimits) error {
+	if err := limits.validate(); err != nil {
+		logrus.WithError(err).Errorln("invalid log limits")
+		return err
+	}
+
 	stepsV0 := []*StepV0{}
 
 	// 1. load all stages from the V0 database.
@@ -34,9 +54,16 @@ func MigrateLogs(source, target *sql.DB, buildId int64) error {
 	}
 	defer tx.Rollback()
 
+	summary := new(logSummary)
+
 	// 3. iterate through the list and convert from
 	// the 0.x to the 1.x structure and insert.
 	for _, stepV0 := range stepsV0 {
+		if limits.expired(stepV0) {
+			summary.expire(stepV0)
+			continue
+		}
+
 		logsV0 := &LogsV0{}
 		err := meddler.QueryRow(source, logsV0, fmt.Sprintf("select * from logs where log_job_id = %d", stepV0.ID))
 		if err == sql.ErrNoRows {
@@ -47,6 +74,8 @@ func MigrateLogs(source, target *sql.DB, buildId int64) error {
 			continue
 		}
 
+		logsV0.Data = limits.truncate(stepV0, logsV0.Data, summary)
+
 		logsV1 := &LogsV1{
 			ID:   logsV0.ProcID,
 			Data: logsV0.Data,
@@ -59,12 +88,75 @@ func MigrateLogs(source, target *sql.DB, buildId int64) error {
 		}
 	}
 
+	summary.print()
+
 	logrus.Infof("migration complete")
 	return tx.Commit()
 }
 
+// S3Options configures how logs are uploaded to S3.
+type S3Options struct {
+	Bucket string
+	Prefix string
+
+	// Gzip compresses the logs and sets the content
+	// encoding of the object to gzip.
+	Gzip bool
+
+	// Encryption is the server-side encryption algorithm
+	// (AES256 or aws:kms). KMSKeyID is optional and only
+	// used with aws:kms.
+	Encryption string
+	KMSKeyID   string
+
+	// StorageClass is the s3 storage class (optional).
+	StorageClass string
+
+	// Metadata and Tagging attach the repository slug,
+	// build number and step name to the object.
+	Metadata bool
+	Tagging  bool
+
+	// Resume skips logs that already exist in s3 with a
+	// matching size and checksum.
+	Resume bool
+
+	// Verify compares the uploaded object with the source
+	// logs after each upload.
+	Verify bool
+
+	// RetryFile is the path of a file to which missing
+	// or mismatched uploads are written (optional).
+	// RetryFrom is the path of a retry file from a prior
+	// run; if set, only the listed steps are migrated.
+	RetryFile string
+	RetryFrom string
+
+	// Limits configures the log age and size limits.
+	Limits LogLimits
+}
+
+// helper function returns an error if the encryption options
+// are not a valid combination.
+func (o S3Options) validate() error {
+	switch o.Encryption {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("unsupported s3 encryption: %s", o.Encryption)
+	}
+	if o.KMSKeyID != "" && o.Encryption != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("the s3 kms key id requires aws:kms encryption")
+	}
+	return o.Limits.validate()
+}
+
 // MigrateLogsS3 migrates the steps from the V0 database to S3.
-func MigrateLogsS3(source *sql.DB, bucket, prefix string, buildId int64) error {
+func MigrateLogsS3(source *sql.DB, buildId int64, opts S3Options) error {
+	if err := opts.validate(); err != nil {
+		logrus.WithError(err).Errorln("invalid s3 options")
+		return err
+	}
+
 	stepsV0 := []*StepV0{}
 
 	// 1. load all stages from the V0 database.
@@ -83,10 +175,40 @@ func MigrateLogsS3(source *sql.DB, bucket, prefix string, buildId int64) error {
 			// S3ForcePathStyle: aws.Bool(pathStyle),
 		}),
 	)
+	uploader := s3manager.NewUploader(sess)
+	client := s3.New(sess)
+
+	if opts.RetryFrom != "" {
+		stepsV0, err = filterRetry(stepsV0, opts.RetryFrom)
+		if err != nil {
+			logrus.WithError(err).Errorln("cannot read retry file")
+			return err
+		}
+		logrus.Infof("retrying %d logs", len(stepsV0))
+	}
+
+	var retry io.Writer = ioutil.Discard
+	if opts.RetryFile != "" {
+		f, err := os.Create(opts.RetryFile)
+		if err != nil {
+			logrus.WithError(err).Errorln("cannot create retry file")
+			return err
+		}
+		defer f.Close()
+		retry = f
+	}
+
+	var skipped, failed int
+	summary := new(logSummary)
 
 	// 3. iterate through the list and convert from
 	// the 0.x to the 1.x structure and insert.
 	for i, stepV0 := range stepsV0 {
+		if opts.Limits.expired(stepV0) {
+			summary.expire(stepV0)
+			continue
+		}
+
 		logsV0 := &LogsV0{}
 		err := meddler.QueryRow(source, logsV0, fmt.Sprintf("select * from logs where log_job_id = %d", stepV0.ID))
 		if err == sql.ErrNoRows {
@@ -101,29 +223,359 @@ func MigrateLogsS3(source *sql.DB, bucket, prefix string, buildId int64) error {
 			continue
 		}
 
+		logsV0.Data = opts.Limits.truncate(stepV0, logsV0.Data, summary)
+
+		input, body, err := s3UploadInput(source, opts, stepV0, logsV0)
+		if err != nil {
+			logrus.WithError(err).Errorln("migration failed")
+			return err
+		}
+
+		if opts.Resume {
+			ok, err := s3Matches(client, input, body)
+			if err != nil {
+				logrus.WithError(err).Warnf("cannot check logs for step: id: %d", stepV0.ID)
+			}
+			if ok {
+				logrus.Debugf("skipping uploaded logs for step: %d", stepV0.ID)
+				skipped++
+				continue
+			}
+		}
+
 		logrus.Debugf("uploading logs for step: %d", stepV0.ID)
 
-		uploader := s3manager.NewUploader(sess)
-		input := &s3manager.UploadInput{
-			ACL:    aws.String("private"),
-			Bucket: aws.String(bucket),
-			Key:    aws.String(s3key(prefix, logsV0.ProcID)),
-			Body:   bytes.NewBuffer(logsV0.Data),
+		// the logs are uploaded in a single part so that s3
+		// verifies the content md5 of the complete object.
+		_, err = uploader.Upload(input, func(u *s3manager.Uploader) {
+			if size := int64(len(body)); size >= u.PartSize {
+				u.PartSize = size + 1
+			}
+		})
+		if err != nil && opts.RetryFile != "" {
+			logrus.WithError(err).Warnf("upload failed for step: id: %d", stepV0.ID)
+			fmt.Fprintf(retry, "%d\tupload failed\n", stepV0.ID)
+			failed++
+			continue
 		}
-		_, err = uploader.Upload(input)
 		if err != nil {
 			logrus.WithError(err).Errorln("migration failed")
 			return err
 		}
+
+		if opts.Verify {
+			ok, err := s3Matches(client, input, body)
+			if err != nil {
+				logrus.WithError(err).Warnf("cannot verify logs for step: id: %d", stepV0.ID)
+			}
+			if !ok {
+				logrus.Warnf("verification failed for step: id: %d", stepV0.ID)
+				fmt.Fprintf(retry, "%d\tverification failed\n", stepV0.ID)
+				failed++
+			}
+		}
+
 		if i%1000 == 0 {
 			logrus.Infof("uploaded: %d", stepV0.ID)
 		}
 	}
 
+	summary.print()
+
+	if skipped > 0 {
+		logrus.Infof("skipped %d uploaded logs", skipped)
+	}
+	if failed > 0 {
+		logrus.Warnf("%d logs failed to upload or verify", failed)
+	}
+
 	logrus.Infof("migration complete")
 	return nil
 }
 
+// helper function returns the s3 upload input for the
+// step logs, applying the encoding, encryption, storage
+// class and metadata options.
+func s3UploadInput(source *sql.DB, opts S3Options, stepV0 *StepV0, logsV0 *LogsV0) (*s3manager.UploadInput, []byte, error) {
+	body := logsV0.Data
+	sum := md5.Sum(logsV0.Data)
+
+	input := &s3manager.UploadInput{
+		ACL:    aws.String("private"),
+		Bucket: aws.String(opts.Bucket),
+		Key:    aws.String(s3key(opts.Prefix, logsV0.ProcID)),
+		Metadata: map[string]*string{
+			"Md5": aws.String(hex.EncodeToString(sum[:])),
+		},
+	}
+
+	if opts.Gzip {
+		buf := new(bytes.Buffer)
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write(logsV0.Data); err != nil {
+			return nil, nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, nil, err
+		}
+		body = buf.Bytes()
+		input.ContentEncoding = aws.String("gzip")
+		input.ContentType = aws.String("text/plain")
+	}
+	input.Body = bytes.NewReader(body)
+	bodySum := md5.Sum(body)
+	input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(bodySum[:]))
+	if opts.Encryption != "" {
+		input.ServerSideEncryption = aws.String(opts.Encryption)
+	}
+	if opts.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(opts.KMSKeyID)
+	}
+	if opts.StorageClass != "" {
+		input.StorageClass = aws.String(opts.StorageClass)
+	}
+
+	if !opts.Metadata && !opts.Tagging {
+		return input, body, nil
+	}
+
+	meta := &LogsMetaV0{}
+	err := meddler.QueryRow(source, meta, fmt.Sprintf(logsMetaQuery, stepV0.ID))
+	if err != nil {
+		logrus.WithError(err).Warnf("cannot find metadata for step: id: %d", stepV0.ID)
+		return input, body, nil
+	}
+
+	if opts.Metadata {
+		input.Metadata["Repo"] = aws.String(meta.RepoFullname)
+		input.Metadata["Build"] = aws.String(fmt.Sprint(meta.BuildNumber))
+		input.Metadata["Step"] = aws.String(meta.ProcName)
+	}
+	if opts.Tagging {
+		tags := url.Values{}
+		tags.Set("repo", meta.RepoFullname)
+		tags.Set("build", fmt.Sprint(meta.BuildNumber))
+		tags.Set("step", meta.ProcName)
+		input.Tagging = aws.String(tags.Encode())
+	}
+	return input, body, nil
+}
+
+// helper function returns true if the object exists in s3
+// and matches the size and checksum of the upload body. The
+// etag is only an md5 checksum for single part uploads that
+// are not encrypted with kms. For other objects only the
+// size and the md5 of the source logs stored in the object
+// metadata at upload time are compared, which does not prove
+// the stored content matches.
+func s3Matches(client *s3.S3, input *s3manager.UploadInput, body []byte) (bool, error) {
+	out, err := client.HeadObject(&s3.HeadObjectInput{
+		Bucket: input.Bucket,
+		Key:    input.Key,
+	})
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if aws.Int64Value(out.ContentLength) != int64(len(body)) {
+		return false, nil
+	}
+
+	sum := md5.Sum(body)
+	etag := strings.Trim(aws.StringValue(out.ETag), `"`)
+	if etag == hex.EncodeToString(sum[:]) {
+		return true, nil
+	}
+
+	expected := aws.StringValue(input.Metadata["Md5"])
+	actual := aws.StringValue(out.Metadata["Md5"])
+	return actual != "" && actual == expected, nil
+}
+
+// helper function filters the steps to those listed in
+// the retry file written by a previous run.
+func filterRetry(stepsV0 []*StepV0, path string) ([]*StepV0, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids := map[int64]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		id, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var filtered []*StepV0
+	for _, stepV0 := range stepsV0 {
+		if ids[stepV0.ID] {
+			filtered = append(filtered, stepV0)
+		}
+	}
+	return filtered, nil
+}
+
+// LogLimits configures age and size limits for migrated logs.
+type LogLimits struct {
+	// MaxAge skips logs for steps that started before
+	// the given duration (optional).
+	MaxAge time.Duration
+
+	// MaxSize truncates logs larger than the given number
+	// of bytes (optional). If KeepTail is true the end of
+	// the logs is kept, otherwise the beginning.
+	MaxSize  int64
+	KeepTail bool
+}
+
+// minLogSize is the smallest maximum log size, which leaves
+// room for the truncation marker.
+const minLogSize = 1024
+
+// helper function returns an error if the maximum log size
+// is too small to fit the truncation marker.
+func (l LogLimits) validate() error {
+	if l.MaxSize != 0 && l.MaxSize < minLogSize {
+		return fmt.Errorf("the maximum log size must be at least %d bytes", minLogSize)
+	}
+	return nil
+}
+
+// helper function returns true if the step logs are older
+// than the maximum age.
+func (l LogLimits) expired(stepV0 *StepV0) bool {
+	if l.MaxAge == 0 || stepV0.Started == 0 {
+		return false
+	}
+	return time.Unix(stepV0.Started, 0).Before(time.Now().Add(-l.MaxAge))
+}
+
+// helper function truncates the step logs if they exceed
+// the maximum size, and records the change in the summary.
+func (l LogLimits) truncate(stepV0 *StepV0, data []byte, summary *logSummary) []byte {
+	if l.MaxSize == 0 || int64(len(data)) <= l.MaxSize {
+		return data
+	}
+	truncated := truncateLogs(data, l.MaxSize, l.KeepTail)
+	saved := len(data) - len(truncated)
+	if saved < 0 {
+		saved = 0
+	}
+	summary.truncate(stepV0, saved)
+	return truncated
+}
+
+// logLine is a single line of 0.x and 1.x logs, which are
+// stored as a json array of lines.
+type logLine struct {
+	Proc string `json:"proc,omitempty"`
+	Pos  int    `json:"pos"`
+	Out  string `json:"out"`
+	Time int64  `json:"time"`
+}
+
+// helper function truncates the logs to the given number
+// of bytes, keeping either the first or last lines and adding
+// a marker line where lines were removed. The marker counts
+// towards the limit, which must be at least minLogSize. Logs
+// that are not a json array are truncated as raw bytes.
+func truncateLogs(data []byte, limit int64, tail bool) []byte {
+	marker := fmt.Sprintf("[drone-migrate: logs truncated, %d bytes exceeded the %d byte limit]\n", int64(len(data))-limit, limit)
+
+	var lines []json.RawMessage
+	if err := json.Unmarshal(data, &lines); err != nil {
+		keep := limit - int64(len(marker))
+		if keep < 0 {
+			keep = 0
+		}
+		if tail {
+			return append([]byte(marker), data[int64(len(data))-keep:]...)
+		}
+		return append(data[:keep:keep], marker...)
+	}
+
+	out, _ := json.Marshal(&logLine{Out: marker})
+
+	// the array brackets and the marker line count towards
+	// the limit.
+	size := int64(len(out)) + 2
+	var keep []json.RawMessage
+	for i := range lines {
+		line := lines[i]
+		if tail {
+			line = lines[len(lines)-1-i]
+		}
+		size += int64(len(line)) + 1
+		if size > limit {
+			break
+		}
+		keep = append(keep, line)
+	}
+
+	if tail {
+		// lines were collected in reverse order.
+		for i, j := 0, len(keep)-1; i < j; i, j = i+1, j-1 {
+			keep[i], keep[j] = keep[j], keep[i]
+		}
+		keep = append([]json.RawMessage{out}, keep...)
+	} else {
+		keep = append(keep, out)
+	}
+
+	result, err := json.Marshal(keep)
+	if err != nil {
+		return data
+	}
+	return result
+}
+
+// logSummary records the logs skipped or truncated by the
+// log limits.
+type logSummary struct {
+	expired   int
+	truncated []string
+	saved     int64
+}
+
+func (s *logSummary) expire(stepV0 *StepV0) {
+	logrus.Debugf("skipping expired logs for step: id: %d", stepV0.ID)
+	s.expired++
+}
+
+func (s *logSummary) truncate(stepV0 *StepV0, saved int) {
+	logrus.Debugf("truncating logs for step: id: %d", stepV0.ID)
+	s.truncated = append(s.truncated, fmt.Sprintf("%d (%s): %d bytes", stepV0.ID, stepV0.Name, saved))
+	s.saved += int64(saved)
+}
+
+func (s *logSummary) print() {
+	if s.expired > 0 {
+		logrus.Infof("skipped %d expired logs", s.expired)
+	}
+	if len(s.truncated) == 0 {
+		return
+	}
+	logrus.Infof("truncated %d logs, saved %d bytes", len(s.truncated), s.saved)
+	for _, step := range s.truncated {
+		logrus.Infof("truncated step: %s", step)
+	}
+}
+
 func s3key(prefix string, step int64) string {
 	return path.Join("/", prefix, fmt.Sprint(step))
 }
@@ -138,3 +590,15 @@ WHERE proc_ppid != 0
 	AND builds.build_id > ?
 ORDER BY proc_id ASC
 `
+
+const logsMetaQuery = `
+SELECT
+	proc_id,
+	proc_name,
+	build_number,
+	repo_full_name
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE proc_id = %d
+`
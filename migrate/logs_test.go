@@ -0,0 +1,108 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTruncateLogs(t *testing.T) {
+	var lines []logLine
+	for i := 0; i < 100; i++ {
+		lines = append(lines, logLine{Pos: i, Out: strings.Repeat("x", 20) + "\n"})
+	}
+	data, _ := json.Marshal(lines)
+	raw := bytes.Repeat([]byte("y"), 1000)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		limit int64
+		tail  bool
+		first string
+		last  string
+	}{
+		{name: "json head", data: data, limit: 500, first: `"pos":0`, last: "logs truncated"},
+		{name: "json tail", data: data, limit: 500, tail: true, first: "logs truncated", last: `"pos":99`},
+		{name: "json slightly over", data: data, limit: int64(len(data)) - 1, first: `"pos":0`, last: "logs truncated"},
+		{name: "raw head", data: raw, limit: 500, first: "yyy", last: "logs truncated"},
+		{name: "raw tail", data: raw, limit: 500, tail: true, first: "logs truncated", last: "yyy"},
+		{name: "raw slightly over", data: raw, limit: 999, first: "yyy", last: "logs truncated"},
+	}
+
+	for _, test := range tests {
+		got := truncateLogs(test.data, test.limit, test.tail)
+		if int64(len(got)) > test.limit {
+			t.Errorf("%s: want at most %d bytes, got %d", test.name, test.limit, len(got))
+		}
+		s := string(got)
+		if i, j := strings.Index(s, test.first), strings.LastIndex(s, test.last); i == -1 || j == -1 || i > j {
+			t.Errorf("%s: want %q before %q, got %s", test.name, test.first, test.last, s)
+		}
+		if bytes.HasPrefix(test.data, []byte("[")) && !json.Valid(got) {
+			t.Errorf("%s: want valid json, got %s", test.name, s)
+		}
+	}
+}
+
+func TestTruncateLogsMinSize(t *testing.T) {
+	var lines []logLine
+	for i := 0; i < 100; i++ {
+		lines = append(lines, logLine{Pos: i, Out: strings.Repeat("x", 20) + "\n"})
+	}
+	data, _ := json.Marshal(lines)
+	raw := bytes.Repeat([]byte("y"), 10000)
+
+	for _, in := range [][]byte{data, raw} {
+		for _, tail := range []bool{false, true} {
+			got := truncateLogs(in, minLogSize, tail)
+			if len(got) > minLogSize {
+				t.Errorf("want at most %d bytes, got %d", minLogSize, len(got))
+			}
+			if !strings.Contains(string(got), "logs truncated") {
+				t.Errorf("want marker, got %s", got)
+			}
+		}
+	}
+}
+
+func TestLogLimitsValidate(t *testing.T) {
+	tests := []struct {
+		size int64
+		ok   bool
+	}{
+		{size: 0, ok: true},
+		{size: 10, ok: false},
+		{size: minLogSize - 1, ok: false},
+		{size: minLogSize, ok: true},
+	}
+	for _, test := range tests {
+		err := LogLimits{MaxSize: test.size}.validate()
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%d: want valid %v, got error %v", test.size, test.ok, err)
+		}
+	}
+
+	opts := S3Options{Limits: LogLimits{MaxSize: 10}}
+	if err := opts.validate(); err == nil {
+		t.Errorf("want s3 options with an invalid log size rejected")
+	}
+}
+
+func TestLogLimitsTruncate(t *testing.T) {
+	limits := LogLimits{MaxSize: minLogSize}
+	summary := new(logSummary)
+	got := limits.truncate(&StepV0{ID: 1}, bytes.Repeat([]byte("y"), minLogSize+1), summary)
+	if int64(len(got)) > limits.MaxSize {
+		t.Errorf("want at most %d bytes, got %d", limits.MaxSize, len(got))
+	}
+	if summary.saved <= 0 {
+		t.Errorf("want saved bytes, got %d", summary.saved)
+	}
+
+	data := []byte("[]")
+	if got := limits.truncate(&StepV0{ID: 2}, data, summary); !bytes.Equal(got, data) {
+		t.Errorf("want logs within the limit unchanged, got %s", got)
+	}
+}
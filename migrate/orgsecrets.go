@@ -0,0 +1,221 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// PromoteOptions configures the promotion of repository
+// secrets to organization secrets.
+type PromoteOptions struct {
+	// MinRepos is the minimum number of repositories in a
+	// namespace that must share the secret.
+	MinRepos int
+
+	// DeleteRepoSecrets deletes the repository secrets
+	// that are redundant once promoted.
+	DeleteRepoSecrets bool
+
+	// DryRun prints the report without making changes.
+	DryRun bool
+}
+
+// PromoteOrgSecrets promotes repository secrets that have the
+// same name and value in multiple repositories of a namespace
+// to a single organization secret, and writes a report of the
+// promoted secrets to w.
+func PromoteOrgSecrets(target *sql.DB, key string, w io.Writer, opts PromoteOptions) error {
+	block, err := parseOptionalKey(key)
+	if err != nil {
+		logrus.WithError(err).Errorln("cannot read encryption key")
+		return err
+	}
+	if block != nil {
+		logrus.Infof("encryption key fingerprint: %s", keyFingerprint(key))
+	}
+
+	secrets := []*repoSecretV1{}
+	if err := meddler.QueryAll(target, &secrets, repoSecretListQuery); err != nil {
+		return err
+	}
+
+	// group the secrets by namespace and name.
+	groups := map[string][]*repoSecretV1{}
+	var keys []string
+	for _, secret := range secrets {
+		if secret.Name == ".dockerconfigjson" {
+			continue
+		}
+		key := secret.Namespace + "/" + secret.Name
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		secret.Data = unseal(block, secret.Data)
+		groups[key] = append(groups[key], secret)
+	}
+	sort.Strings(keys)
+
+	if opts.MinRepos < 2 {
+		opts.MinRepos = 2
+	}
+
+	// group the repositories by namespace, to report the
+	// repositories that gain access to a promoted secret.
+	repos := []*RepoV1{}
+	if err := meddler.QueryAll(target, &repos, repoActivateQuery); err != nil {
+		return err
+	}
+	namespaces := map[string][]string{}
+	for _, repo := range repos {
+		namespaces[repo.Namespace] = append(namespaces[repo.Namespace], repo.Slug)
+	}
+
+	countQuery := orgSecretCountQuery
+	if meddler.Default == meddler.PostgreSQL {
+		countQuery = orgSecretCountQueryPostgres
+	}
+
+	tx, err := target.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var promoted int
+	for _, key := range keys {
+		group := groups[key]
+		first := group[0]
+
+		log := logrus.WithFields(logrus.Fields{
+			"namespace": first.Namespace,
+			"secret":    first.Name,
+		})
+
+		if len(group) < opts.MinRepos {
+			continue
+		}
+
+		if reason := promoteConflict(group); reason != "" {
+			fmt.Fprintf(w, "%s: skipped, %s (%d repositories)\n", key, reason, len(group))
+			continue
+		}
+
+		var count int
+		err := tx.QueryRow(countQuery, first.Namespace, first.Name).Scan(&count)
+		if err != nil {
+			log.WithError(err).Errorln("error querying for existing organization secret")
+			return err
+		}
+		if count > 0 {
+			fmt.Fprintf(w, "%s: skipped, organization secret exists (%d repositories)\n", key, len(group))
+			continue
+		}
+
+		fmt.Fprintf(w, "%s: promote (%d repositories)\n", key, len(group))
+		shared := map[string]bool{}
+		for _, secret := range group {
+			fmt.Fprintf(w, "  - %s\n", secret.Slug)
+			shared[secret.Slug] = true
+		}
+		// every repository in the namespace can read the
+		// organization secret, not only those that had the
+		// repository secret.
+		for _, slug := range namespaces[first.Namespace] {
+			if !shared[slug] {
+				fmt.Fprintf(w, "  + %s (gains access)\n", slug)
+			}
+		}
+		promoted++
+
+		if opts.DryRun {
+			continue
+		}
+
+		data, err := seal(block, first.Data)
+		if err != nil {
+			log.WithError(err).Errorln("encryption failed")
+			return err
+		}
+
+		orgSecretV1 := &OrgSecretV1{
+			Namespace:       first.Namespace,
+			Name:            first.Name,
+			Data:            data,
+			PullRequest:     first.PullRequest,
+			PullRequestPush: first.PullRequestPush,
+		}
+		if err := meddler.Insert(tx, "orgsecrets", orgSecretV1); err != nil {
+			log.WithError(err).Errorln("failed to insert organization secret")
+			return err
+		}
+
+		if !opts.DeleteRepoSecrets {
+			continue
+		}
+		for _, secret := range group {
+			if _, err := tx.Exec(fmt.Sprintf(deleteSecret, secret.ID)); err != nil {
+				log.WithError(err).Errorln("failed to delete repository secret")
+				return err
+			}
+		}
+		log.Debugln("deleted redundant repository secrets")
+	}
+
+	if opts.DryRun {
+		logrus.Infof("dry run: %d secrets can be promoted", promoted)
+		return nil
+	}
+
+	logrus.Infof("promoted %d secrets", promoted)
+	return tx.Commit()
+}
+
+// helper function returns the reason the secrets cannot be
+// promoted to a single organization secret, or an empty
+// string if the secrets are identical.
+func promoteConflict(group []*repoSecretV1) string {
+	first := group[0]
+	for _, secret := range group[1:] {
+		switch {
+		case secret.Data != first.Data:
+			return "values differ"
+		case secret.PullRequest != first.PullRequest,
+			secret.PullRequestPush != first.PullRequestPush:
+			return "pull request settings differ"
+		}
+	}
+	return ""
+}
+
+const repoSecretListQuery = `
+SELECT
+	secrets.*,
+	repo_namespace,
+	repo_slug
+FROM secrets
+INNER JOIN repos ON secrets.secret_repo_id = repos.repo_id
+ORDER BY secret_id ASC
+`
+
+const orgSecretCountQuery = `
+SELECT count(*)
+FROM orgsecrets
+WHERE secret_namespace = ?
+  AND secret_name = ?
+`
+
+const orgSecretCountQueryPostgres = `
+SELECT count(*)
+FROM orgsecrets
+WHERE secret_namespace = $1
+  AND secret_name = $2
+`
+
+const deleteSecret = `
+DELETE FROM secrets WHERE secret_id = %d
+`
@@ -0,0 +1,490 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// PreflightOptions configures the preflight check.
+type PreflightOptions struct {
+	// Driver is the target database driver, which determines
+	// if the unique indexes are case-insensitive.
+	Driver string
+
+	// Strategy is the conflict resolution strategy used to
+	// generate the resolution sql, one of keep-newest,
+	// keep-active or rename (optional).
+	Strategy string
+
+	// PreserveTokens checks the 1.x user hash, which is
+	// only derived from the 0.x user hash if the tokens are
+	// preserved.
+	PreserveTokens bool
+
+	// Rules are the repository rename rules (optional).
+	Rules *RenameRules
+}
+
+// conflict is a set of 0.x rows that violate a 1.x unique
+// index once migrated.
+type conflict struct {
+	index string
+	key   string
+	rows  []*conflictRow
+}
+
+// conflictRow is a 0.x row in conflict.
+type conflictRow struct {
+	id     int64
+	label  string
+	active bool
+
+	// drop and rename return the sql statements that remove
+	// the row from the migration, or rename the row.
+	drop   func() []string
+	rename func() []string
+}
+
+// Preflight checks the V0 database for rows that violate the
+// unique indexes of the V1 database once migrated, and writes
+// a report of the conflicts to w. If a strategy is provided,
+// the report includes the sql statements that resolve the
+// conflicts in the V0 database. The report is formatted as a
+// sql file.
+func Preflight(source *sql.DB, w io.Writer, opts PreflightOptions) error {
+	switch opts.Strategy {
+	case "", "keep-newest", "keep-active", "rename":
+	default:
+		return fmt.Errorf("unknown preflight strategy: %s", opts.Strategy)
+	}
+
+	checks := []func(*sql.DB, PreflightOptions) ([]*conflict, error){
+		preflightUsers,
+		preflightRepos,
+		preflightBuilds,
+		preflightStages,
+		preflightSteps,
+		preflightSecrets,
+	}
+
+	var conflicts []*conflict
+	for _, check := range checks {
+		found, err := check(source, opts)
+		if err != nil {
+			return err
+		}
+		conflicts = append(conflicts, found...)
+	}
+
+	fmt.Fprintf(w, "-- found %d conflicts with the 1.0 unique indexes\n", len(conflicts))
+	if opts.Strategy != "" {
+		fmt.Fprintf(w, "-- resolution strategy: %s, run against the 0.8 database\n", opts.Strategy)
+	}
+
+	for _, c := range conflicts {
+		fmt.Fprintf(w, "\n-- %s: %q (%d rows)\n", c.index, c.key, len(c.rows))
+		for _, row := range c.rows {
+			fmt.Fprintf(w, "--   %s\n", row.label)
+		}
+		if opts.Strategy == "" {
+			continue
+		}
+		for _, stmt := range resolveConflict(c, opts.Strategy) {
+			fmt.Fprintln(w, stmt)
+		}
+	}
+
+	if len(conflicts) != 0 {
+		logrus.Warnf("found %d conflicts", len(conflicts))
+		return fmt.Errorf("preflight found %d conflicts", len(conflicts))
+	}
+
+	logrus.Infoln("preflight complete, no conflicts found")
+	return nil
+}
+
+// helper function returns the sql statements that resolve
+// the conflict with the strategy. The rows are ordered by id,
+// so the last row is the newest.
+func resolveConflict(c *conflict, strategy string) []string {
+	keep := len(c.rows) - 1
+	if strategy == "keep-active" {
+		for i := len(c.rows) - 1; i >= 0; i-- {
+			if c.rows[i].active {
+				keep = i
+				break
+			}
+		}
+	}
+
+	var stmts []string
+	stmts = append(stmts, fmt.Sprintf("-- keep %s", c.rows[keep].label))
+	for i, row := range c.rows {
+		if i == keep {
+			continue
+		}
+		switch {
+		case strategy == "rename" && row.rename != nil:
+			stmts = append(stmts, row.rename()...)
+		case strategy == "rename":
+			stmts = append(stmts, fmt.Sprintf("-- cannot rename %s", row.label))
+			stmts = append(stmts, row.drop()...)
+		default:
+			stmts = append(stmts, row.drop()...)
+		}
+	}
+	return stmts
+}
+
+// helper function returns true if the unique index on the
+// column is case-insensitive in the target database.
+func foldIndex(driver, index string) bool {
+	switch driver {
+	case "mysql":
+		// the default mysql collation is case-insensitive.
+		return true
+	case "sqlite3":
+		return index == "users.user_login"
+	default:
+		return false
+	}
+}
+
+// helper function groups the rows by key and returns the
+// groups with more than one row.
+func groupConflicts(index string, fold bool, keys []string, rows []*conflictRow) []*conflict {
+	groups := map[string]*conflict{}
+	var order []string
+	for i, key := range keys {
+		if fold {
+			key = strings.ToLower(key)
+		}
+		c, ok := groups[key]
+		if !ok {
+			c = &conflict{index: index, key: key}
+			groups[key] = c
+			order = append(order, key)
+		}
+		c.rows = append(c.rows, rows[i])
+	}
+
+	var conflicts []*conflict
+	for _, key := range order {
+		c := groups[key]
+		if len(c.rows) < 2 {
+			continue
+		}
+		sort.Slice(c.rows, func(i, j int) bool {
+			return c.rows[i].id < c.rows[j].id
+		})
+		conflicts = append(conflicts, c)
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].key < conflicts[j].key
+	})
+	return conflicts
+}
+
+func preflightUsers(source *sql.DB, opts PreflightOptions) ([]*conflict, error) {
+	usersV0 := []*UserV0{}
+	if err := meddler.QueryAll(source, &usersV0, userImportQuery); err != nil {
+		return nil, err
+	}
+
+	var logins, hashes []string
+	var loginRows, hashRows []*conflictRow
+	for _, userV0 := range usersV0 {
+		userV0 := userV0
+		label := fmt.Sprintf("user id %d %s", userV0.ID, userV0.Login)
+		if userV0.Active {
+			label += " (active)"
+		}
+		logins = append(logins, userV0.Login)
+		loginRows = append(loginRows, &conflictRow{
+			id:     userV0.ID,
+			label:  label,
+			active: userV0.Active,
+			drop: func() []string {
+				return []string{fmt.Sprintf("DELETE FROM users WHERE user_id = %d;", userV0.ID)}
+			},
+			rename: func() []string {
+				login := fmt.Sprintf("%s-%d", userV0.Login, userV0.ID)
+				return []string{fmt.Sprintf("UPDATE users SET user_login = %s WHERE user_id = %d;", quote(login), userV0.ID)}
+			},
+		})
+		if opts.PreserveTokens && userV0.Hash != "" {
+			// the 1.x user hash is the token derived from the
+			// login, so the rows also conflict on the login,
+			// and the 0.x hash is not changed, which would
+			// invalidate the token.
+			hashes = append(hashes, legacyToken(userV0.Login, userV0.Hash))
+			hashRows = append(hashRows, &conflictRow{
+				id:     userV0.ID,
+				label:  label,
+				active: userV0.Active,
+				drop: func() []string {
+					return []string{fmt.Sprintf("-- %s: resolved with the users.user_login conflict", label)}
+				},
+			})
+		}
+	}
+
+	conflicts := groupConflicts("users.user_login", foldIndex(opts.Driver, "users.user_login"), logins, loginRows)
+	conflicts = append(conflicts, groupConflicts("users.user_hash", foldIndex(opts.Driver, "users.user_hash"), hashes, hashRows)...)
+	return conflicts, nil
+}
+
+func preflightRepos(source *sql.DB, opts PreflightOptions) ([]*conflict, error) {
+	reposV0 := []*RepoV0{}
+	if err := meddler.QueryAll(source, &reposV0, repoImportQuery); err != nil {
+		return nil, err
+	}
+
+	var slugs []string
+	var rows []*conflictRow
+	for _, repoV0 := range reposV0 {
+		id := repoV0.ID
+		owner := repoV0.Owner
+		name := repoV0.Name
+		label := fmt.Sprintf("repo id %d %s", repoV0.ID, repoV0.FullName)
+		if repoV0.IsActive {
+			label += " (active)"
+		}
+		opts.Rules.renameV0(repoV0)
+		slugs = append(slugs, repoV0.FullName)
+		rows = append(rows, &conflictRow{
+			id:     id,
+			label:  label,
+			active: repoV0.IsActive,
+			// the repository is excluded from the migration,
+			// which only includes repositories with an owner.
+			drop: func() []string {
+				return []string{fmt.Sprintf("UPDATE repos SET repo_user_id = 0 WHERE repo_id = %d;", id)}
+			},
+			rename: func() []string {
+				renamed := fmt.Sprintf("%s-%d", name, id)
+				return []string{fmt.Sprintf("UPDATE repos SET repo_name = %s, repo_full_name = %s WHERE repo_id = %d;",
+					quote(renamed), quote(owner+"/"+renamed), id)}
+			},
+		})
+	}
+
+	return groupConflicts("repos.repo_slug", foldIndex(opts.Driver, "repos.repo_slug"), slugs, rows), nil
+}
+
+func preflightBuilds(source *sql.DB, opts PreflightOptions) ([]*conflict, error) {
+	rows, err := source.Query(buildConflictQuery)
+	if err != nil {
+		return nil, err
+	}
+	type buildKey struct{ repo, number int64 }
+	var keys []buildKey
+	for rows.Next() {
+		var key buildKey
+		if err := rows.Scan(&key.repo, &key.number); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var conflicts []*conflict
+	for _, key := range keys {
+		buildsV0 := []*BuildV0{}
+		if err := meddler.QueryAll(source, &buildsV0, fmt.Sprintf(buildConflictListQuery, key.repo, key.number)); err != nil {
+			return nil, err
+		}
+
+		var next int64
+		if err := source.QueryRow(fmt.Sprintf(buildNextNumberQuery, key.repo)).Scan(&next); err != nil {
+			return nil, err
+		}
+
+		c := &conflict{
+			index: "builds.build_repo_id, builds.build_number",
+			key:   fmt.Sprintf("repo id %d build %d", key.repo, key.number),
+		}
+		for _, buildV0 := range buildsV0 {
+			buildV0 := buildV0
+			c.rows = append(c.rows, &conflictRow{
+				id:    buildV0.ID,
+				label: fmt.Sprintf("build id %d (%s)", buildV0.ID, buildV0.Status),
+				drop: func() []string {
+					return []string{fmt.Sprintf("DELETE FROM builds WHERE build_id = %d;", buildV0.ID)}
+				},
+				// the build is renumbered after the last
+				// build of the repository.
+				rename: func() []string {
+					number := next
+					next++
+					return []string{
+						fmt.Sprintf("UPDATE builds SET build_number = %d WHERE build_id = %d;", number, buildV0.ID),
+						fmt.Sprintf("UPDATE repos SET repo_counter = %d WHERE repo_id = %d AND repo_counter < %d;", number, key.repo, number),
+					}
+				},
+			})
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, nil
+}
+
+func preflightStages(source *sql.DB, opts PreflightOptions) ([]*conflict, error) {
+	return preflightProcs(source, "stages.stage_build_id, stages.stage_number", stageConflictQuery)
+}
+
+func preflightSteps(source *sql.DB, opts PreflightOptions) ([]*conflict, error) {
+	return preflightProcs(source, "steps.step_stage_id, steps.step_number", stepConflictQuery)
+}
+
+// helper function returns the procs with a duplicate process
+// id, which is migrated as the stage or step number.
+func preflightProcs(source *sql.DB, index, query string) ([]*conflict, error) {
+	rows, err := source.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	type procKey struct {
+		build     int64
+		ppid, pid int
+	}
+	var keys []procKey
+	for rows.Next() {
+		var key procKey
+		if err := rows.Scan(&key.build, &key.ppid, &key.pid); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var conflicts []*conflict
+	for _, key := range keys {
+		procsV0 := []*StepV0{}
+		if err := meddler.QueryAll(source, &procsV0, fmt.Sprintf(procConflictListQuery, key.build, key.ppid, key.pid)); err != nil {
+			return nil, err
+		}
+
+		c := &conflict{
+			index: index,
+			key:   fmt.Sprintf("build id %d proc %d", key.build, key.pid),
+		}
+		for _, procV0 := range procsV0 {
+			procV0 := procV0
+			c.rows = append(c.rows, &conflictRow{
+				id:    procV0.ID,
+				label: fmt.Sprintf("proc id %d %s (%s)", procV0.ID, procV0.Name, procV0.State),
+				// procs cannot be renumbered because the
+				// steps reference the stage number.
+				drop: func() []string {
+					return []string{fmt.Sprintf("DELETE FROM procs WHERE proc_id = %d;", procV0.ID)}
+				},
+			})
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, nil
+}
+
+func preflightSecrets(source *sql.DB, opts PreflightOptions) ([]*conflict, error) {
+	secretsV0, err := listRepoSecretsV0(source)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	var rows []*conflictRow
+	for _, secretV0 := range secretsV0 {
+		secretV0 := secretV0
+		keys = append(keys, fmt.Sprintf("%s (repo id %d) %s", secretV0.RepoFullname, secretV0.RepoID, secretV0.Name))
+		rows = append(rows, &conflictRow{
+			id:    secretV0.ID,
+			label: fmt.Sprintf("secret id %d %s", secretV0.ID, secretV0.Name),
+			drop: func() []string {
+				return []string{fmt.Sprintf("DELETE FROM secrets WHERE secret_id = %d;", secretV0.ID)}
+			},
+			rename: func() []string {
+				name := fmt.Sprintf("%s_%d", secretV0.Name, secretV0.ID)
+				return []string{fmt.Sprintf("UPDATE secrets SET secret_name = %s WHERE secret_id = %d;", quote(name), secretV0.ID)}
+			},
+		})
+	}
+
+	return groupConflicts("secrets.secret_repo_id, secrets.secret_name", foldIndex(opts.Driver, "secrets.secret_name"), keys, rows), nil
+}
+
+// helper function returns the string as a sql literal.
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+const buildConflictQuery = `
+SELECT build_repo_id, build_number
+FROM builds
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE repo_user_id > 0
+GROUP BY build_repo_id, build_number
+HAVING COUNT(*) > 1
+ORDER BY build_repo_id, build_number
+`
+
+const buildConflictListQuery = `
+SELECT *
+FROM builds
+WHERE build_repo_id = %d
+  AND build_number = %d
+ORDER BY build_id
+`
+
+const buildNextNumberQuery = `
+SELECT COALESCE(MAX(build_number), 0) + 1
+FROM builds
+WHERE build_repo_id = %d
+`
+
+const stageConflictQuery = `
+SELECT proc_build_id, proc_ppid, proc_pid
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE proc_ppid = 0
+  AND repo_user_id > 0
+GROUP BY proc_build_id, proc_ppid, proc_pid
+HAVING COUNT(*) > 1
+ORDER BY proc_build_id, proc_pid
+`
+
+const stepConflictQuery = `
+SELECT proc_build_id, proc_ppid, proc_pid
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE proc_ppid != 0
+  AND repo_user_id > 0
+GROUP BY proc_build_id, proc_ppid, proc_pid
+HAVING COUNT(*) > 1
+ORDER BY proc_build_id, proc_pid
+`
+
+const procConflictListQuery = `
+SELECT *
+FROM procs
+WHERE proc_build_id = %d
+  AND proc_ppid = %d
+  AND proc_pid = %d
+ORDER BY proc_id
+`
@@ -1,19 +1,36 @@
 package migrate
 
 import (
+	"crypto/cipher"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 
 	"github.com/russross/meddler"
 	"github.com/sirupsen/logrus"
 )
 
 // MigrateRegistries migrates the registry crendeitals
-// from the V0 database to the V1 database.
-func MigrateRegistries(source, target *sql.DB) error {
+// from the V0 database to the V1 database. If an encryption
+// key is provided the credentials are encrypted as they
+// are written. If orgSecrets is true, credentials that are
+// identical for every repository in a namespace are written
+// as a single organization secret. The repositories are found
+// by the name after applying the rename rules (optional).
+func MigrateRegistries(source, target *sql.DB, key string, orgSecrets bool, rules *RenameRules) error {
+	block, err := parseOptionalKey(key)
+	if err != nil {
+		logrus.WithError(err).Errorln("cannot read encryption key")
+		return err
+	}
+	if block != nil {
+		logrus.Infof("encryption key fingerprint: %s", keyFingerprint(key))
+	}
+
 	registriesV0 := []*RegistryV0{}
-	dockerConfigs := make(map[string]DockerConfig, 0)
 
 	if err := meddler.QueryAll(source, &registriesV0, registryImportQuery); err != nil {
 		return err
@@ -28,37 +45,25 @@ func MigrateRegistries(source, target *sql.DB) error {
 
 	defer tx.Rollback()
 
-	for _, registryV0 := range registriesV0 {
-		log := logrus.WithFields(logrus.Fields{
-			"repo": registryV0.RepoFullname,
-			"addr": registryV0.Addr,
-		})
-
-		log.Debugln("prepare registry")
-
-		if _, ok := dockerConfigs[registryV0.RepoFullname]; !ok {
-			dockerConfigs[registryV0.RepoFullname] = DockerConfig{
-				AuthConfigs: make(map[string]AuthConfig, 0),
-			}
-		}
-
-		dockerConfigs[registryV0.RepoFullname].AuthConfigs[registryV0.Addr] = AuthConfig{
-			Username: registryV0.Username,
-			Password: registryV0.Password,
-			Email:    registryV0.Email,
-		}
+	dockerConfigs := groupRegistries(registriesV0)
 
-		log.Debugln("prepare complete")
+	var repoFullnames []string
+	for repoFullname := range dockerConfigs {
+		repoFullnames = append(repoFullnames, repoFullname)
 	}
+	sort.Strings(repoFullnames)
 
-	for repoFullname, dockerConfig := range dockerConfigs {
+	// group the docker configs by namespace, so that
+	// identical configs can be written once per namespace.
+	var namespaces []string
+	registries := map[string][]*registryRepo{}
+
+	for _, repoFullname := range repoFullnames {
 		log := logrus.WithFields(logrus.Fields{
 			"repo": repoFullname,
 		})
 
-		log.Debugln("migrate registry")
-
-		result, err := json.Marshal(dockerConfig)
+		result, err := json.Marshal(dockerConfigs[repoFullname])
 
 		if err != nil {
 			log.WithError(err).Errorln("failed to build docker config")
@@ -67,53 +72,280 @@ func MigrateRegistries(source, target *sql.DB) error {
 
 		repoV1 := &RepoV1{}
 
-		if err := meddler.QueryRow(target, repoV1, fmt.Sprintf(repoSlugQuery, repoFullname)); err != nil {
+		if err := meddler.QueryRow(target, repoV1, fmt.Sprintf(repoSlugQuery, rules.Slug(repoFullname))); err != nil {
 			log.WithError(err).Errorln("failed to get registry repo")
 			continue
 		}
 
+		if _, ok := registries[repoV1.Namespace]; !ok {
+			namespaces = append(namespaces, repoV1.Namespace)
+		}
+		registries[repoV1.Namespace] = append(registries[repoV1.Namespace], &registryRepo{
+			repo:   repoV1,
+			config: dockerConfigs[repoFullname],
+			data:   string(result),
+		})
+	}
+
+	for _, namespace := range namespaces {
+		repos := registries[namespace]
+
+		if orgSecrets && identicalRegistries(repos) {
+			if err := migrateOrgRegistry(tx, block, namespace, repos[0].config); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, registry := range repos {
+			if err := migrateRepoRegistry(tx, block, registry.repo, registry.config); err != nil {
+				return err
+			}
+		}
+	}
+
+	logrus.Infof("migration complete")
+	return tx.Commit()
+}
+
+// ReportImagePullSecrets writes a report of every repository
+// with registry credentials to w, including the pipeline yaml
+// required to use the migrated credentials. In 1.x registry
+// credentials are only used if the pipeline references the
+// secret in the image_pull_secrets section. The repositories
+// are reported by the name after applying the rename rules
+// (optional).
+func ReportImagePullSecrets(source *sql.DB, w io.Writer, rules *RenameRules) error {
+	registriesV0 := []*RegistryV0{}
+
+	if err := meddler.QueryAll(source, &registriesV0, registryImportQuery); err != nil {
+		return err
+	}
+
+	var repoFullnames []string
+	addrs := map[string][]string{}
+	for _, registryV0 := range registriesV0 {
+		repoFullname := rules.Slug(registryV0.RepoFullname)
+		if _, ok := addrs[repoFullname]; !ok {
+			repoFullnames = append(repoFullnames, repoFullname)
+		}
+		addrs[repoFullname] = append(addrs[repoFullname], registryV0.Addr)
+	}
+	sort.Strings(repoFullnames)
+
+	for _, repoFullname := range repoFullnames {
+		sort.Strings(addrs[repoFullname])
+		fmt.Fprintf(w, "\n# %s\n", repoFullname)
+		fmt.Fprintf(w, "registries: %s\n\n", strings.Join(addrs[repoFullname], ", "))
+		fmt.Fprintf(w, "  kind: pipeline\n")
+		fmt.Fprintf(w, "  name: default\n\n")
+		fmt.Fprintf(w, "  image_pull_secrets:\n")
+		fmt.Fprintf(w, "  - .dockerconfigjson\n")
+	}
+
+	logrus.Infof("found %d repositories with registry credentials", len(repoFullnames))
+	return nil
+}
+
+// helper function groups the registry credentials by the
+// repository full name.
+func groupRegistries(registriesV0 []*RegistryV0) map[string]DockerConfig {
+	dockerConfigs := map[string]DockerConfig{}
+	for _, registryV0 := range registriesV0 {
+		config, ok := dockerConfigs[registryV0.RepoFullname]
+		if !ok {
+			config = DockerConfig{AuthConfigs: map[string]AuthConfig{}}
+			dockerConfigs[registryV0.RepoFullname] = config
+		}
+		config.AuthConfigs[registryV0.Addr] = AuthConfig{
+			Username:      registryV0.Username,
+			Password:      registryV0.Password,
+			Email:         registryV0.Email,
+			IdentityToken: registryV0.Token,
+		}
+	}
+	return dockerConfigs
+}
+
+// registryRepo is the docker config of a 1.x repository.
+type registryRepo struct {
+	repo   *RepoV1
+	config DockerConfig
+	data   string
+}
+
+// helper function returns true if there are multiple
+// repositories and all have the same docker config.
+func identicalRegistries(repos []*registryRepo) bool {
+	if len(repos) < 2 {
+		return false
+	}
+	for _, registry := range repos[1:] {
+		if registry.data != repos[0].data {
+			return false
+		}
+	}
+	return true
+}
+
+// helper function writes the docker config to the repository
+// .dockerconfigjson secret, merging with the existing secret.
+func migrateRepoRegistry(tx *sql.Tx, block cipher.Block, repoV1 *RepoV1, config DockerConfig) error {
+	log := logrus.WithFields(logrus.Fields{
+		"repo": repoV1.Slug,
+	})
+
+	log.Debugln("migrate registry")
+
+	var insert bool
+	existing := &RegistryV1{}
+	// check for existing and update if it exists--upsert doesn't work because the pk can't be determined based on the source relation
+	err := meddler.QueryRow(tx, existing, fmt.Sprintf(registryFindExistingQuery, repoV1.ID, ".dockerconfigjson"))
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		// perform an insert if we didn't find an existing secret for this repo
+		insert = true
+	} else if err != nil {
+		log.WithError(err).Errorln("error querying for existing registry credentials")
+		return err
+	}
+
+	plaintext, changed, err := mergeDockerConfig(block, existing.Data, config)
+	if err != nil {
+		log.WithError(err).Errorln("failed to build docker config")
+		return err
+	}
+
+	if !insert && !changed {
+		log.Debugln("skip unchanged registry secret")
+		return nil
+	}
+
+	data, err := seal(block, plaintext)
+	if err != nil {
+		log.WithError(err).Errorln("encryption failed")
+		return err
+	}
+
+	if insert {
+		log.Debugln("inserting new registry secret")
 		registryV1 := &RegistryV1{
 			RepoID:      repoV1.ID,
 			Name:        ".dockerconfigjson",
-			Data:        string(result),
+			Data:        data,
 			PullRequest: true,
 		}
-
-		var insert bool
-		existing := &RegistryV1{}
-		// check for existing and update if it exists--upsert doesn't work because the pk can't be determined based on the source relation
-		err = meddler.QueryRow(tx, existing, fmt.Sprintf(registryFindExistingQuery, registryV1.RepoID, registryV1.Name))
-		if err != nil && err.Error() == "sql: no rows in result set" {
-			// perform an insert if we didn't find an existing secret for this repo
-			insert = true
-		} else if err != nil {
-			log.WithError(err).Errorln("error querying for existing registry credentials")
+		if err := meddler.Insert(tx, "secrets", registryV1); err != nil {
+			log.WithError(err).Errorln("failed to insert new registry credential secret")
 			return err
 		}
+	} else {
+		log.Debugln("updating existing registry secret")
+		// we're just updating the data value of the existing registry secret in case it changed
+		// the update method works here because the pk is explicitly marked in the struct/not set from the source datasource
+		existing.Data = data
+		if err := meddler.Update(tx, "secrets", existing); err != nil {
+			log.WithError(err).Errorln("failed to update exisitng registry credential secret")
+			return err
+		}
+	}
 
-		if insert {
-			log.Debugln("inserting new registry secret")
-			if err := meddler.Insert(tx, "secrets", registryV1); err != nil {
-				log.WithError(err).Errorln("failed to insert new registry credential secret")
-				return err
-			}
-		} else {
-			log.Debugln("updating existing registry secret")
-			// we're just updating the data value of the existing registry secret in case it changed
-			// the update method works here because the pk is explicitly marked in the struct/not set from the source datasource
-			existing.Data = registryV1.Data
-			if err := meddler.Update(tx, "secrets", existing); err != nil {
-				log.WithError(err).Errorln("failed to update exisitng registry credential secret")
-				return err
-			}
+	log.Debugln("migration complete")
+	return nil
+}
+
+// helper function writes the docker config to the organization
+// .dockerconfigjson secret, merging with the existing secret.
+func migrateOrgRegistry(tx *sql.Tx, block cipher.Block, namespace string, config DockerConfig) error {
+	log := logrus.WithFields(logrus.Fields{
+		"namespace": namespace,
+	})
+
+	log.Debugln("migrate organization registry")
+
+	var insert bool
+	existing := &OrgSecretV1{}
+	findQuery := orgSecretFindExistingQuery
+	if meddler.Default == meddler.PostgreSQL {
+		findQuery = orgSecretFindExistingQueryPostgres
+	}
+	err := meddler.QueryRow(tx, existing, findQuery, namespace, ".dockerconfigjson")
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		insert = true
+	} else if err != nil {
+		log.WithError(err).Errorln("error querying for existing organization registry credentials")
+		return err
+	}
+
+	plaintext, changed, err := mergeDockerConfig(block, existing.Data, config)
+	if err != nil {
+		log.WithError(err).Errorln("failed to build docker config")
+		return err
+	}
+
+	if !insert && !changed {
+		log.Debugln("skip unchanged organization registry secret")
+		return nil
+	}
+
+	data, err := seal(block, plaintext)
+	if err != nil {
+		log.WithError(err).Errorln("encryption failed")
+		return err
+	}
+
+	if insert {
+		log.Debugln("inserting new organization registry secret")
+		orgSecretV1 := &OrgSecretV1{
+			Namespace:   namespace,
+			Name:        ".dockerconfigjson",
+			Data:        data,
+			PullRequest: true,
+		}
+		if err := meddler.Insert(tx, "orgsecrets", orgSecretV1); err != nil {
+			log.WithError(err).Errorln("failed to insert new organization registry secret")
+			return err
+		}
+	} else {
+		log.Debugln("updating existing organization registry secret")
+		existing.Data = data
+		if err := meddler.Update(tx, "orgsecrets", existing); err != nil {
+			log.WithError(err).Errorln("failed to update existing organization registry secret")
+			return err
 		}
+	}
 
+	log.Debugln("migration complete")
+	return nil
+}
 
-		log.Debugln("migration complete")
+// helper function merges the docker config into the existing
+// secret data, replacing credentials for the same registry
+// address and keeping all others. It returns the merged
+// plaintext and true if it differs from the existing data.
+func mergeDockerConfig(block cipher.Block, existing string, config DockerConfig) (string, bool, error) {
+	merged := DockerConfig{
+		AuthConfigs: map[string]AuthConfig{},
 	}
 
-	logrus.Infof("migration complete")
-	return tx.Commit()
+	plaintext := unseal(block, existing)
+	if plaintext != "" {
+		if err := json.Unmarshal([]byte(plaintext), &merged); err != nil {
+			logrus.WithError(err).Warnln("cannot parse existing docker config, replacing")
+		}
+		if merged.AuthConfigs == nil {
+			merged.AuthConfigs = map[string]AuthConfig{}
+		}
+	}
+
+	for addr, auth := range config.AuthConfigs {
+		merged.AuthConfigs[addr] = auth
+	}
+
+	result, err := json.Marshal(merged)
+	if err != nil {
+		return "", false, err
+	}
+	return string(result), string(result) != plaintext, nil
 }
 
 const registryImportQuery = `
@@ -127,3 +359,11 @@ WHERE repo_user_id > 0
 const registryFindExistingQuery = `
 SELECT * FROM secrets WHERE secret_repo_id = %d AND secret_name= '%s'
 `
+
+const orgSecretFindExistingQuery = `
+SELECT * FROM orgsecrets WHERE secret_namespace = ? AND secret_name = ?
+`
+
+const orgSecretFindExistingQueryPostgres = `
+SELECT * FROM orgsecrets WHERE secret_namespace = $1 AND secret_name = $2
+`
@@ -0,0 +1,284 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/drone/go-scm/scm"
+	"github.com/hashicorp/go-multierror"
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// ReconcileRenamed updates the namespace, name, slug and
+// identifier of repositories that have been renamed in the
+// source code management system, instead of removing them.
+// If the new name collides with another repository, the
+// renamed repository is merged into the other repository when
+// merge is true, or reported otherwise. The changes are
+// written to w.
+func ReconcileRenamed(db *sql.DB, client *scm.Client, opts RepoOptions, merge bool, w io.Writer) error {
+	repos := []*RepoV1{}
+	var result error
+
+	if err := meddler.QueryAll(db, &repos, repoActivateQuery); err != nil {
+		return err
+	}
+
+	logrus.Infoln("reconciling renamed repositories")
+
+	// the repositories deleted or updated by a merge are
+	// skipped, since the list is read before the merge.
+	done := map[int64]bool{}
+
+	collisionQuery := repoCollisionQuery
+	if meddler.Default == meddler.PostgreSQL {
+		collisionQuery = repoCollisionQueryPostgres
+	}
+
+	var renamed, merged, collisions int
+	for _, repo := range repos {
+		log := logrus.WithFields(logrus.Fields{
+			"repo": repo.Slug,
+		})
+
+		if done[repo.ID] {
+			log.Debugln("skip repository, already merged")
+			continue
+		}
+
+		remoteRepo, _, err := findRemoteRepo(db, client, opts.Overrides, opts.Collaborators, repo)
+
+		if err != nil {
+			log.WithError(err).Errorf("failed to get remote repository")
+			result = multierror.Append(result, err)
+			continue
+		}
+
+		remoteName := scm.Join(remoteRepo.Namespace, remoteRepo.Name)
+		if remoteName == repo.Slug {
+			log.Debugln("skip repository, name matches remote system")
+			continue
+		}
+
+		log = log.WithField("renamed", remoteName)
+
+		existing := &RepoV1{}
+		err = meddler.QueryRow(db, existing, collisionQuery, remoteName, repo.ID)
+		if err != nil && err != sql.ErrNoRows {
+			log.WithError(err).Errorf("failed to query for existing repository")
+			result = multierror.Append(result, err)
+			continue
+		}
+
+		if err == sql.ErrNoRows {
+			fmt.Fprintf(w, "%s: renamed to %s\n", repo.Slug, remoteName)
+			renamed++
+
+			if opts.DryRun {
+				continue
+			}
+
+			renameRepo(repo, remoteRepo)
+			if err := meddler.Update(db, "repos", (*RepoV1Update)(repo)); err != nil {
+				log.WithError(err).Errorf("failed to rename repository")
+				result = multierror.Append(result, err)
+				continue
+			}
+
+			log.Debugln("renamed repository")
+			continue
+		}
+
+		if !merge {
+			fmt.Fprintf(w, "%s: renamed to %s, collides with repository id %d\n", repo.Slug, remoteName, existing.ID)
+			collisions++
+			continue
+		}
+
+		fmt.Fprintf(w, "%s: renamed to %s, merged into repository id %d\n", repo.Slug, remoteName, existing.ID)
+		merged++
+
+		if opts.DryRun {
+			continue
+		}
+
+		if err := mergeRepo(db, repo, existing, remoteRepo, w); err != nil {
+			log.WithError(err).Errorf("failed to merge repository")
+			result = multierror.Append(result, err)
+			continue
+		}
+		done[repo.ID] = true
+		done[existing.ID] = true
+
+		log.Debugln("merged repository")
+	}
+
+	logrus.Infof("renamed %d repositories, merged %d repositories, %d collisions", renamed, merged, collisions)
+	return result
+}
+
+// helper function updates the repository with the remote
+// repository namespace, name and identifier.
+func renameRepo(repo *RepoV1, remoteRepo *scm.Repository) {
+	repo.Namespace = remoteRepo.Namespace
+	repo.Name = remoteRepo.Name
+	repo.Slug = scm.Join(remoteRepo.Namespace, remoteRepo.Name)
+	repo.UID = remoteRepo.ID
+	repo.Updated = time.Now().Unix()
+}
+
+// helper function merges the renamed duplicate repository
+// into the existing repository. The duplicate builds are
+// renumbered after the existing builds, secrets are moved
+// unless the existing repository has a secret with the same
+// name, and the duplicate repository and the permissions of
+// the replaced identifiers are deleted.
+func mergeRepo(db *sql.DB, duplicate, existing *RepoV1, remoteRepo *scm.Repository, w io.Writer) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var offset int64
+	if err := tx.QueryRow(fmt.Sprintf(buildMaxNumberQuery, existing.ID)).Scan(&offset); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf(buildMergeQuery, existing.ID, offset, duplicate.ID)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(stageMergeQuery, existing.ID, duplicate.ID)); err != nil {
+		return err
+	}
+
+	countQuery := secretCountQuery
+	permQuery := permRepoDeleteQuery
+	if meddler.Default == meddler.PostgreSQL {
+		countQuery = secretCountQueryPostgres
+		permQuery = permRepoDeleteQueryPostgres
+	}
+
+	secrets := []*SecretV1{}
+	if err := meddler.QueryAll(tx, &secrets, fmt.Sprintf(repoSecretsQuery, duplicate.ID)); err != nil {
+		return err
+	}
+	for _, secret := range secrets {
+		var count int
+		if err := tx.QueryRow(countQuery, existing.ID, secret.Name).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			fmt.Fprintf(w, "  - secret %s exists, discarding duplicate\n", secret.Name)
+			if _, err := tx.Exec(fmt.Sprintf(deleteSecret, secret.ID)); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(secretMoveQuery, existing.ID, secret.ID)); err != nil {
+			return err
+		}
+	}
+
+	var counter int64
+	if err := tx.QueryRow(fmt.Sprintf(buildMaxNumberQuery, existing.ID)).Scan(&counter); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf(deleteRepo, duplicate.ID)); err != nil {
+		return err
+	}
+	// the permissions are kept for the identifier of the
+	// remote repository, which the existing repository is
+	// updated with, and are synced again for the others.
+	for _, uid := range []string{duplicate.UID, existing.UID} {
+		if uid == remoteRepo.ID {
+			continue
+		}
+		if _, err := tx.Exec(permQuery, uid); err != nil {
+			return err
+		}
+	}
+
+	renameRepo(existing, remoteRepo)
+	existing.Active = existing.Active || duplicate.Active
+	if counter > existing.Counter {
+		existing.Counter = counter
+	}
+	if err := meddler.Update(tx, "repos", (*RepoV1Update)(existing)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const repoCollisionQuery = `
+SELECT *
+FROM repos
+WHERE lower(repo_slug) = lower(?)
+  AND repo_id != ?
+`
+
+const repoCollisionQueryPostgres = `
+SELECT *
+FROM repos
+WHERE lower(repo_slug) = lower($1)
+  AND repo_id != $2
+`
+
+const buildMaxNumberQuery = `
+SELECT COALESCE(MAX(build_number), 0)
+FROM builds
+WHERE build_repo_id = %d
+`
+
+const buildMergeQuery = `
+UPDATE builds
+SET build_repo_id = %d, build_number = build_number + %d
+WHERE build_repo_id = %d
+`
+
+const stageMergeQuery = `
+UPDATE stages
+SET stage_repo_id = %d
+WHERE stage_repo_id = %d
+`
+
+const repoSecretsQuery = `
+SELECT *
+FROM secrets
+WHERE secret_repo_id = %d
+`
+
+const secretCountQuery = `
+SELECT count(*)
+FROM secrets
+WHERE secret_repo_id = ?
+  AND secret_name = ?
+`
+
+const secretCountQueryPostgres = `
+SELECT count(*)
+FROM secrets
+WHERE secret_repo_id = $1
+  AND secret_name = $2
+`
+
+const permRepoDeleteQuery = `
+DELETE FROM perms
+WHERE perm_repo_uid = ?
+`
+
+const permRepoDeleteQueryPostgres = `
+DELETE FROM perms
+WHERE perm_repo_uid = $1
+`
+
+const secretMoveQuery = `
+UPDATE secrets
+SET secret_repo_id = %d
+WHERE secret_id = %d
+`
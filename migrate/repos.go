@@ -4,8 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/dchest/uniuri"
@@ -18,8 +18,9 @@ import (
 )
 
 // MigrateRepos migrates the repositories from the V0
-// database to the V1 database.
-func MigrateRepos(source, target *sql.DB) error {
+// database to the V1 database, renaming the repositories
+// with the rename rules (optional).
+func MigrateRepos(source, target *sql.DB, rules *RenameRules) error {
 	reposV0 := []*RepoV0{}
 
 	if err := meddler.QueryAll(source, &reposV0, repoImportQuery); err != nil {
@@ -49,10 +50,8 @@ func MigrateRepos(source, target *sql.DB) error {
 
 		log.Debugln("migrate repository")
 
-		if repoV0.Owner == "NYTimes" {
-			log.Debugln("lowercasing repo: " + repoV0.FullName)
-			repoV0.Owner = "nytimes"
-			repoV0.FullName = "nytimes/" + repoV0.Name
+		if rules.renameV0(repoV0) {
+			log.Debugln("renamed repo: " + repoV0.FullName)
 		}
 
 		repoV1 := &RepoV1{
@@ -96,7 +95,8 @@ func MigrateRepos(source, target *sql.DB) error {
 		}
 
 		var insert bool
-		err = meddler.QueryRow(tx, &RepoV1{}, fmt.Sprintf("SELECT * FROM repos WHERE repo_id = %d", repoV1.ID))
+		existing := &RepoV1{}
+		err = meddler.QueryRow(tx, existing, fmt.Sprintf("SELECT * FROM repos WHERE repo_id = %d", repoV1.ID))
 		if err != nil && err.Error() == "sql: no rows in result set" {
 			insert = true
 		} else if err != nil {
@@ -112,6 +112,15 @@ func MigrateRepos(source, target *sql.DB) error {
 			}
 		} else {
 			log.Debugln("updating existing repo")
+			// keep the existing keys, which would otherwise
+			// invalidate exported encrypted secrets and
+			// signatures on every re-run.
+			if existing.Signer != "" {
+				repoV1.Signer = existing.Signer
+			}
+			if existing.Secret != "" {
+				repoV1.Secret = existing.Secret
+			}
 			update := (*RepoV1Update)(repoV1)
 			if err := meddler.Update(tx, "repos", update); err != nil {
 				log.WithError(err).Errorln("failed to update existing repo")
@@ -134,12 +143,33 @@ func MigrateRepos(source, target *sql.DB) error {
 	return tx.Commit()
 }
 
+// RepoOptions configures the repository updates made with
+// the source code management system.
+type RepoOptions struct {
+	// Overrides are the per-namespace token overrides.
+	Overrides TokenOverrides
+
+	// Collaborators configures the fallback to the tokens
+	// of other users with push access when the owner token
+	// fails (optional).
+	Collaborators *Collaborators
+
+	// Metadata updates the clone urls, link, default branch
+	// and visibility with the values fetched from the source
+	// code management system.
+	Metadata bool
+
+	// DryRun prints the report without making changes.
+	DryRun bool
+}
+
 // UpdateRepoIdentifiers updates the repository identifiers
 // from temporary values (assigned during migration) to the
-// value fetched from the source code management system.
-func UpdateRepoIdentifiers(db *sql.DB, client *scm.Client, overrideToken string, overrideOrgs string) error {
+// value fetched from the source code management system. If
+// opts.Metadata is true, the changed metadata fields are
+// written to w.
+func UpdateRepoIdentifiers(db *sql.DB, client *scm.Client, opts RepoOptions, w io.Writer) error {
 	repos := []*RepoV1{}
-	var result error
 
 	if err := meddler.QueryAll(db, &repos, repoTempQuery); err != nil {
 		return err
@@ -147,57 +177,47 @@ func UpdateRepoIdentifiers(db *sql.DB, client *scm.Client, overrideToken string,
 
 	logrus.Infoln("updating repository metadata")
 
-	orgs := strings.Split(overrideOrgs, ",")
+	result := updateRepos(db, client, repos, opts, w)
 
-	for _, repo := range repos {
-		log := logrus.WithFields(logrus.Fields{
-			"repo": repo.Slug,
-		})
+	logrus.Infoln("repository metadata update complete")
+	return result
+}
 
-		user := &UserV1{}
+// RefreshRepoMetadata updates the metadata of all repositories
+// with the values fetched from the source code management
+// system, and writes the changed fields to w.
+func RefreshRepoMetadata(db *sql.DB, client *scm.Client, opts RepoOptions, w io.Writer) error {
+	repos := []*RepoV1{}
 
-		if err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, repo.UserID)); err != nil {
-			log.WithError(err).Errorf("failed to get repository owner")
-			multierror.Append(result, err)
-			continue
-		}
+	if err := meddler.QueryAll(db, &repos, repoActivateQuery); err != nil {
+		return err
+	}
 
-		var (
-			tok *scm.Token
-			override bool
-		)
+	logrus.Infof("refreshing metadata for %d repositories", len(repos))
 
-		for _, org := range orgs {
-			if org == repo.Namespace {
-				override = true
-				break
-			}
-		}
+	opts.Metadata = true
+	result := updateRepos(db, client, repos, opts, w)
 
-		if overrideToken != "" && override {
-			log = log.WithField("owner", "overridden by provided token")
-			tok = &scm.Token{
-				Token:   overrideToken,
-			}
-		} else {
-			log = log.WithField("owner", user.Login)
-			tok = &scm.Token{
-				Token:   user.Token,
-				Refresh: user.Refresh,
-			}
-			if user.Expiry > 0 {
-				tok.Expires = time.Unix(user.Expiry, 0)
-			}
-		}
+	logrus.Infoln("repository metadata refresh complete")
+	return result
+}
 
+// helper function updates the repository identifiers, and
+// optionally the metadata, from the source code management
+// system.
+func updateRepos(db *sql.DB, client *scm.Client, repos []*RepoV1, opts RepoOptions, w io.Writer) error {
+	var result error
 
-		ctx := scm.WithContext(context.Background(), tok)
+	for _, repo := range repos {
+		log := logrus.WithFields(logrus.Fields{
+			"repo": repo.Slug,
+		})
 
-		remoteRepo, _, err := client.Repositories.Find(ctx, scm.Join(repo.Namespace, repo.Name))
+		remoteRepo, collaborator, err := findRemoteRepo(db, client, opts.Overrides, opts.Collaborators, repo)
 
 		if err != nil {
 			log.WithError(err).Errorf("failed to get remote repository")
-			multierror.Append(result, err)
+			result = multierror.Append(result, err)
 			continue
 		}
 
@@ -206,22 +226,95 @@ func UpdateRepoIdentifiers(db *sql.DB, client *scm.Client, overrideToken string,
 			continue
 		}
 
-		if _, err := db.Exec(fmt.Sprintf(repoUpdateQuery, remoteRepo.ID, repo.ID)); err != nil {
-			log.WithError(err).Errorf("failed to update metadata with uid %s and repo id %d", remoteRepo.ID, repo.ID)
-			multierror.Append(result, err)
+		if opts.Metadata {
+			changes := repoMetadataChanges(repo, remoteRepo)
+			for _, change := range changes {
+				fmt.Fprintf(w, "%s: %s: %q -> %q\n", repo.Slug, change.field, change.old, change.new)
+			}
+			if len(changes) != 0 && !opts.DryRun {
+				repo.Updated = time.Now().Unix()
+				if err := meddler.Update(db, "repos", (*RepoV1Update)(repo)); err != nil {
+					log.WithError(err).Errorf("failed to update metadata with uid %s and repo id %d", remoteRepo.ID, repo.ID)
+					result = multierror.Append(result, err)
+					continue
+				}
+			}
+		} else if !opts.DryRun {
+			if _, err := db.Exec(fmt.Sprintf(repoUpdateQuery, remoteRepo.ID, repo.ID)); err != nil {
+				log.WithError(err).Errorf("failed to update metadata with uid %s and repo id %d", remoteRepo.ID, repo.ID)
+				result = multierror.Append(result, err)
+			}
+		}
+
+		if collaborator != nil && opts.Collaborators.Reassign && !opts.DryRun {
+			if err := reassignOwner(db, repo, collaborator); err != nil {
+				log.WithError(err).Errorf("failed to reassign repository owner")
+				result = multierror.Append(result, err)
+			} else {
+				log.WithField("owner", collaborator.Login).Infoln("reassigned repository owner")
+			}
 		}
 
 		log.Debugln("updated metadata")
 	}
 
-	logrus.Infoln("repository metadata update complete")
 	return result
 }
 
+// repoChange is a changed repository metadata field.
+type repoChange struct {
+	field string
+	old   string
+	new   string
+}
+
+// helper function applies the remote repository metadata to
+// the repository and returns the changed fields.
+func repoMetadataChanges(repo *RepoV1, remoteRepo *scm.Repository) []repoChange {
+	var changes []repoChange
+	set := func(field string, value *string, remote string) {
+		if remote != "" && *value != remote {
+			changes = append(changes, repoChange{field, *value, remote})
+			*value = remote
+		}
+	}
+
+	set("repo_uid", &repo.UID, remoteRepo.ID)
+	set("repo_clone_url", &repo.HTTPURL, remoteRepo.Clone)
+	set("repo_ssh_url", &repo.SSHURL, remoteRepo.CloneSSH)
+	set("repo_html_url", &repo.Link, remoteRepo.Link)
+	set("repo_branch", &repo.Branch, remoteRepo.Branch)
+
+	if repo.Private != remoteRepo.Private {
+		changes = append(changes, repoChange{
+			"repo_private",
+			fmt.Sprint(repo.Private),
+			fmt.Sprint(remoteRepo.Private),
+		})
+		repo.Private = remoteRepo.Private
+	}
+
+	// the source code management system only reports if
+	// the repository is private, in which case an internal
+	// visibility is preserved.
+	visibility := "public"
+	if remoteRepo.Private {
+		visibility = "private"
+		if repo.Visibility == "internal" {
+			visibility = "internal"
+		}
+	}
+	set("repo_visibility", &repo.Visibility, visibility)
+
+	return changes
+}
+
 // ActivateRepositories re-activates the repositories.
 // This will create new webhooks and populate any empty
-// values (security keys, etc).
-func ActivateRepositories(db *sql.DB, client drone.Client) error {
+// values (security keys, etc). If collaborators is not nil,
+// other users with push access are used when activation
+// with the owner account fails.
+func ActivateRepositories(db *sql.DB, client drone.Client, collaborators *Collaborators) error {
 	repos := []*RepoV1{}
 	var result error
 
@@ -244,44 +337,41 @@ func ActivateRepositories(db *sql.DB, client drone.Client) error {
 
 		user := &UserV1{}
 
-		if err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, repo.UserID)); err != nil {
+		err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, repo.UserID))
+		if err != nil {
 			log.WithError(err).Errorf("failed to get repository owner")
-			multierror.Append(result, err)
-			continue
-		}
-
-		log = log.WithField("owner", user.Login)
-
-		// make sure an entry exists in the permission table
-		// to ensure the user can activate the repository.
-		permV1 := &PermV1{
-			UserID:  user.ID,
-			RepoUID: repo.UID,
-			Read:    true,
-			Write:   true,
-			Admin:   true,
-			Synced:  time.Now().Unix(),
-			Created: time.Now().Unix(),
-			Updated: time.Now().Unix(),
-		}
-		if err := meddler.Insert(db, "perms", permV1); err != nil {
-			log.WithError(err).Debugln("cannot insert permissions. permissions may already exist.")
 		} else {
-			log.Debugln("successfully inserted permissions")
+			err = activateRepo(db, client, repo, user)
 		}
 
-		config := new(oauth2.Config)
+		if err != nil && collaborators != nil {
+			log.WithError(err).Warnln("activation failed, trying collaborators")
 
-		client.SetClient(config.Client(
-			oauth2.NoContext,
-			&oauth2.Token{
-				AccessToken: user.Hash,
-			},
-		))
+			users, ferr := collaborators.find(db, repo)
+			if ferr != nil {
+				log.WithError(ferr).Errorf("failed to get repository collaborators")
+			}
+			for _, collaborator := range users {
+				if err = collaborators.activate(db, client, repo, collaborator); err != nil {
+					log.WithError(err).WithField("collaborator", collaborator.Login).Debugln("activation with collaborator failed")
+					continue
+				}
+				log.WithField("collaborator", collaborator.Login).Infoln("activated with collaborator account")
+				if collaborators.Reassign {
+					if rerr := reassignOwner(db, repo, collaborator); rerr != nil {
+						log.WithError(rerr).Errorf("failed to reassign repository owner")
+						result = multierror.Append(result, rerr)
+					} else {
+						log.WithField("owner", collaborator.Login).Infoln("reassigned repository owner")
+					}
+				}
+				break
+			}
+		}
 
-		if _, err := client.RepoPost(repo.Namespace, repo.Name); err != nil {
+		if err != nil {
 			log.WithError(err).Errorf("activation failed")
-			multierror.Append(result, err)
+			result = multierror.Append(result, err)
 			continue
 		}
 
@@ -292,6 +382,51 @@ func ActivateRepositories(db *sql.DB, client drone.Client) error {
 	return result
 }
 
+// helper function activates the repository with the user
+// account.
+func activateRepo(db *sql.DB, client drone.Client, repo *RepoV1, user *UserV1) error {
+	log := logrus.WithFields(logrus.Fields{
+		"repo": repo.Slug,
+		"user": user.Login,
+	})
+
+	// make sure an entry exists in the permission table
+	// to ensure the user can activate the repository.
+	permV1 := &PermV1{
+		UserID:  user.ID,
+		RepoUID: repo.UID,
+		Read:    true,
+		Write:   true,
+		Admin:   true,
+		Synced:  time.Now().Unix(),
+		Created: time.Now().Unix(),
+		Updated: time.Now().Unix(),
+	}
+	if err := meddler.Insert(db, "perms", permV1); err != nil {
+		log.WithError(err).Debugln("cannot insert permissions. permissions may already exist.")
+	} else {
+		log.Debugln("successfully inserted permissions")
+	}
+
+	return postRepo(client, repo, user)
+}
+
+// helper function activates the repository in Drone with
+// the user token.
+func postRepo(client drone.Client, repo *RepoV1, user *UserV1) error {
+	config := new(oauth2.Config)
+
+	client.SetClient(config.Client(
+		oauth2.NoContext,
+		&oauth2.Token{
+			AccessToken: user.Hash,
+		},
+	))
+
+	_, err := client.RepoPost(repo.Namespace, repo.Name)
+	return err
+}
+
 func ActivateReposPreflight(db *sql.DB, client drone.Client) error {
 	repos := []*RepoV1{}
 	var result error
@@ -345,7 +480,7 @@ func ActivateReposPreflight(db *sql.DB, client drone.Client) error {
 
 // RemoveRenamed removes repositories that have been renamed
 // or cannot be found in the remote system.
-func RemoveRenamed(db *sql.DB, client *scm.Client) error {
+func RemoveRenamed(db *sql.DB, client *scm.Client, overrides TokenOverrides) error {
 	repos := []*RepoV1{}
 	var result error
 
@@ -360,23 +495,16 @@ func RemoveRenamed(db *sql.DB, client *scm.Client) error {
 			"repo": repo.Slug,
 		})
 
-		user := &UserV1{}
+		tok, owner, err := findRepoToken(db, overrides, repo)
 
-		if err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, repo.UserID)); err != nil {
+		if err != nil {
 			log.WithError(err).Errorf("failed to get repository owner")
 			multierror.Append(result, err)
 			continue
 		}
 
-		log = log.WithField("owner", user.Login)
+		log = log.WithField("owner", owner)
 
-		tok := &scm.Token{
-			Token:   user.Token,
-			Refresh: user.Refresh,
-		}
-		if user.Expiry > 0 {
-			tok.Expires = time.Unix(user.Expiry, 0)
-		}
 		ctx := scm.WithContext(context.Background(), tok)
 
 		remoteRepo, _, err := client.Repositories.Find(ctx, scm.Join(repo.Namespace, repo.Name))
@@ -408,7 +536,7 @@ func RemoveRenamed(db *sql.DB, client *scm.Client) error {
 
 // RemoveNotFound removes repositories that are not found
 // in the remote system.
-func RemoveNotFound(db *sql.DB, client *scm.Client) error {
+func RemoveNotFound(db *sql.DB, client *scm.Client, overrides TokenOverrides) error {
 	repos := []*RepoV1{}
 	var result error
 
@@ -423,26 +551,19 @@ func RemoveNotFound(db *sql.DB, client *scm.Client) error {
 			"repo": repo.Slug,
 		})
 
-		user := &UserV1{}
+		tok, owner, err := findRepoToken(db, overrides, repo)
 
-		if err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, repo.UserID)); err != nil {
+		if err != nil {
 			log.WithError(err).Errorf("failed to get repository owner")
 			multierror.Append(result, err)
 			continue
 		}
 
-		log = log.WithField("owner", user.Login)
+		log = log.WithField("owner", owner)
 
-		tok := &scm.Token{
-			Token:   user.Token,
-			Refresh: user.Refresh,
-		}
-		if user.Expiry > 0 {
-			tok.Expires = time.Unix(user.Expiry, 0)
-		}
 		ctx := scm.WithContext(context.Background(), tok)
 
-		_, _, err := client.Repositories.Find(ctx, scm.Join(repo.Namespace, repo.Name))
+		_, _, err = client.Repositories.Find(ctx, scm.Join(repo.Namespace, repo.Name))
 
 		if err == nil {
 			log.Debugln("skip repository, found in remote system")
@@ -0,0 +1,178 @@
+package migrate
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultEvents are the events a 0.x secret is exposed to
+// when no events are configured.
+var defaultEvents = []string{"push", "tag", "deployment"}
+
+// ReportSecretRestrictions writes a per-repository report of
+// the 0.x secret restrictions that cannot be represented in
+// 1.x, with a suggested pipeline configuration for each, so
+// the widened exposure can be reviewed. The repositories are
+// reported by the name after applying the rename rules
+// (optional).
+func ReportSecretRestrictions(source *sql.DB, w io.Writer, rules *RenameRules) error {
+	secretsV0, err := listRepoSecretsV0(source)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("checking %d secrets", len(secretsV0))
+
+	var repo string
+	var count int
+	for _, secretV0 := range secretsV0 {
+		images := parseImages(secretV0.Images)
+		events := restrictedEvents(secretV0.Events)
+
+		var lost []string
+		if len(images) != 0 {
+			lost = append(lost, fmt.Sprintf("only exposed to images: %s", strings.Join(images, ", ")))
+		}
+		if len(events) != 0 {
+			lost = append(lost, fmt.Sprintf("only exposed to events: %s", strings.Join(events, ", ")))
+		}
+		if len(lost) == 0 {
+			continue
+		}
+
+		if secretV0.RepoFullname != repo {
+			repo = secretV0.RepoFullname
+			fmt.Fprintf(w, "\n# %s\n", rules.Slug(repo))
+		}
+		count++
+
+		fmt.Fprintf(w, "\nsecret %s:\n", secretV0.Name)
+		for _, restriction := range lost {
+			fmt.Fprintf(w, "  - %s\n", restriction)
+		}
+		fmt.Fprintf(w, "\n%s", suggestedUsage(secretV0.Name, images, events))
+	}
+
+	logrus.Infof("found %d secrets with restrictions not supported in 1.0", count)
+	return nil
+}
+
+// helper function parses the 0.x secret images, which are
+// stored as a json array or comma separated list.
+func parseImages(s string) []string {
+	var images []string
+	if err := json.Unmarshal([]byte(s), &images); err == nil {
+		return images
+	}
+	for _, image := range strings.Split(s, ",") {
+		if image = strings.TrimSpace(image); image != "" {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// helper function returns the events the secret is limited
+// to, or nil if the secret is exposed to all default events.
+// A secret limited to pull_request alone is restricted, since
+// 1.x also exposes it to the default events.
+func restrictedEvents(events []string) []string {
+	if len(events) == 0 {
+		return nil
+	}
+	for _, event := range defaultEvents {
+		if !contains(events, event) {
+			return events
+		}
+	}
+	return nil
+}
+
+// helper function returns a pipeline yaml snippet that
+// restricts the secret to the original images and events.
+func suggestedUsage(name string, images, events []string) string {
+	if len(images) == 0 {
+		images = []string{"<image>"}
+	}
+	var b strings.Builder
+	b.WriteString("  steps:\n")
+	for _, image := range images {
+		fmt.Fprintf(&b, "  - name: <step>\n")
+		fmt.Fprintf(&b, "    image: %s\n", image)
+		fmt.Fprintf(&b, "    environment:\n")
+		fmt.Fprintf(&b, "      %s:\n", strings.ToUpper(name))
+		fmt.Fprintf(&b, "        from_secret: %s\n", name)
+		if len(events) != 0 {
+			fmt.Fprintf(&b, "    when:\n")
+			fmt.Fprintf(&b, "      event: [ %s ]\n", strings.Join(events, ", "))
+		}
+	}
+	return b.String()
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function returns the 0.x secrets of active
+// repositories with the repository full name, ordered by
+// repository and secret name.
+func listRepoSecretsV0(source *sql.DB) ([]*repoSecretV0, error) {
+	secretsV0 := []*SecretV0{}
+	if err := meddler.QueryAll(source, &secretsV0, secretRestrictionQuery); err != nil {
+		return nil, err
+	}
+
+	rows, err := source.Query(repoFullnameQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var secrets []*repoSecretV0
+	for _, secretV0 := range secretsV0 {
+		secrets = append(secrets, &repoSecretV0{
+			SecretV0:     secretV0,
+			RepoFullname: names[secretV0.RepoID],
+		})
+	}
+	return secrets, nil
+}
+
+const secretRestrictionQuery = `
+SELECT secrets.*
+FROM secrets
+INNER JOIN repos ON secrets.secret_repo_id = repos.repo_id
+WHERE repos.repo_user_id > 0
+ORDER BY repo_full_name, secret_name
+`
+
+const repoFullnameQuery = `
+SELECT repo_id, repo_full_name
+FROM repos
+WHERE repo_user_id > 0
+`
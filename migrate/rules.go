@@ -0,0 +1,116 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// RenameRules are the rules used to rename the 0.x
+// repositories during migration.
+type RenameRules struct {
+	// Lowercase is the list of namespaces that are
+	// lowercased, or * for all namespaces.
+	Lowercase []string `json:"lowercase"`
+
+	// Namespaces maps the 0.x namespace to the 1.x
+	// namespace.
+	Namespaces map[string]string `json:"namespaces"`
+
+	// Repos are the regular expression renames applied to
+	// the repository name.
+	Repos []*RepoRenameRule `json:"repos"`
+}
+
+// RepoRenameRule renames the repositories with a name that
+// matches the regular expression.
+type RepoRenameRule struct {
+	// Namespace limits the rule to repositories in the 0.x
+	// namespace (optional).
+	Namespace string `json:"namespace"`
+
+	// Match is the regular expression matched against the
+	// repository name, and Replace is the replacement, which
+	// may reference submatches as $1.
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+
+	re *regexp.Regexp
+}
+
+// ReadRenameRules reads the rename rules from the json file.
+func ReadRenameRules(path string) (*RenameRules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := new(RenameRules)
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules.Repos {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid repository rename rule: %s", err)
+		}
+		rule.re = re
+	}
+	return rules, nil
+}
+
+// Rename returns the 1.x namespace and name of the 0.x
+// repository. The repository name rules are applied first,
+// then the namespace mapping, and last the lowercase rule.
+func (r *RenameRules) Rename(namespace, name string) (string, string) {
+	if r == nil {
+		return namespace, name
+	}
+
+	for _, rule := range r.Repos {
+		if rule.Namespace != "" && rule.Namespace != namespace {
+			continue
+		}
+		if rule.re.MatchString(name) {
+			name = rule.re.ReplaceAllString(name, rule.Replace)
+			break
+		}
+	}
+
+	original := namespace
+	if mapped, ok := r.Namespaces[namespace]; ok {
+		namespace = mapped
+	}
+
+	for _, lower := range r.Lowercase {
+		if lower == "*" || lower == original || lower == namespace {
+			namespace = strings.ToLower(namespace)
+			break
+		}
+	}
+	return namespace, name
+}
+
+// Slug returns the 1.x slug of the 0.x repository full name.
+func (r *RenameRules) Slug(fullname string) string {
+	parts := strings.SplitN(fullname, "/", 2)
+	if len(parts) != 2 {
+		return fullname
+	}
+	namespace, name := r.Rename(parts[0], parts[1])
+	return namespace + "/" + name
+}
+
+// helper function applies the rename rules to the 0.x
+// repository, and returns true if it was renamed.
+func (r *RenameRules) renameV0(repoV0 *RepoV0) bool {
+	namespace, name := r.Rename(repoV0.Owner, repoV0.Name)
+	if namespace == repoV0.Owner && name == repoV0.Name {
+		return false
+	}
+	repoV0.Owner = namespace
+	repoV0.Name = name
+	repoV0.FullName = namespace + "/" + name
+	return true
+}
@@ -0,0 +1,107 @@
+package migrate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenameRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.json")
+	data := []byte(`{
+  "lowercase": ["OctoCat"],
+  "namespaces": {"old-org": "New-Org", "Spaceghost": "spaceghost"},
+  "repos": [
+    {"namespace": "octocat", "match": "^legacy-(.+)$", "replace": "$1"},
+    {"match": "^(.+)\\.git$", "replace": "$1"}
+  ]
+}`)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := ReadRenameRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		namespace string
+		name      string
+		slug      string
+	}{
+		{namespace: "OctoCat", name: "hello-world", slug: "octocat/hello-world"},
+		{namespace: "octocat", name: "legacy-hello-world", slug: "octocat/hello-world"},
+		{namespace: "other", name: "legacy-hello-world", slug: "other/legacy-hello-world"},
+		{namespace: "other", name: "hello-world.git", slug: "other/hello-world"},
+		{namespace: "old-org", name: "hello-world", slug: "New-Org/hello-world"},
+		{namespace: "Spaceghost", name: "Hello-World", slug: "spaceghost/Hello-World"},
+		{namespace: "Other", name: "Hello-World", slug: "Other/Hello-World"},
+	}
+	for _, test := range tests {
+		namespace, name := rules.Rename(test.namespace, test.name)
+		if got := namespace + "/" + name; got != test.slug {
+			t.Errorf("%s/%s: want %s, got %s", test.namespace, test.name, test.slug, got)
+		}
+		if got := rules.Slug(test.namespace + "/" + test.name); got != test.slug {
+			t.Errorf("%s/%s: want slug %s, got %s", test.namespace, test.name, test.slug, got)
+		}
+	}
+}
+
+func TestRenameRulesLowercaseAll(t *testing.T) {
+	rules := &RenameRules{
+		Lowercase:  []string{"*"},
+		Namespaces: map[string]string{"old-org": "New-Org"},
+	}
+	tests := []struct {
+		fullname string
+		slug     string
+	}{
+		{fullname: "OctoCat/Hello-World", slug: "octocat/Hello-World"},
+		{fullname: "old-org/hello-world", slug: "new-org/hello-world"},
+		{fullname: "invalid", slug: "invalid"},
+	}
+	for _, test := range tests {
+		if got := rules.Slug(test.fullname); got != test.slug {
+			t.Errorf("%s: want slug %s, got %s", test.fullname, test.slug, got)
+		}
+	}
+}
+
+func TestRenameRulesNil(t *testing.T) {
+	var rules *RenameRules
+	namespace, name := rules.Rename("OctoCat", "Hello-World")
+	if namespace != "OctoCat" || name != "Hello-World" {
+		t.Errorf("want repository unchanged, got %s/%s", namespace, name)
+	}
+
+	repo := &RepoV0{Owner: "OctoCat", Name: "Hello-World", FullName: "OctoCat/Hello-World"}
+	if rules.renameV0(repo) {
+		t.Errorf("want repository not renamed")
+	}
+}
+
+func TestReadRenameRulesInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.json")
+	data := []byte(`{"repos": [{"match": "(", "replace": ""}]}`)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadRenameRules(path); err == nil {
+		t.Errorf("want error for invalid regular expression")
+	}
+}
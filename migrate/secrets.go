@@ -2,6 +2,7 @@ package migrate
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 
 	"github.com/russross/meddler"
@@ -9,8 +10,18 @@ import (
 )
 
 // MigrateSecrets migrates the secrets V0 database
-// to the V1 database.
-func MigrateSecrets(source, target *sql.DB) error {
+// to the V1 database. If an encryption key is provided
+// the secrets are encrypted as they are written.
+func MigrateSecrets(source, target *sql.DB, key string) error {
+	block, err := parseOptionalKey(key)
+	if err != nil {
+		logrus.WithError(err).Errorln("cannot read encryption key")
+		return err
+	}
+	if block != nil {
+		logrus.Infof("encryption key fingerprint: %s", keyFingerprint(key))
+	}
+
 	secretsV0 := []*SecretV0{}
 
 	if err := meddler.QueryAll(source, &secretsV0, secretImportQuery); err != nil {
@@ -54,7 +65,8 @@ func MigrateSecrets(source, target *sql.DB) error {
 		}
 
 		var insert bool
-		err = meddler.QueryRow(tx, &SecretV1{}, fmt.Sprintf("SELECT * FROM secrets WHERE secret_id = %d", secretV1.ID))
+		existing := &SecretV1{}
+		err = meddler.QueryRow(tx, existing, fmt.Sprintf("SELECT * FROM secrets WHERE secret_id = %d", secretV1.ID))
 		if err != nil && err.Error() == "sql: no rows in result set" {
 			insert = true
 		} else if err != nil {
@@ -62,6 +74,22 @@ func MigrateSecrets(source, target *sql.DB) error {
 			return err
 		}
 
+		// compare the plaintext values so that secrets that
+		// were already encrypted are not needlessly rewritten.
+		if !insert && unseal(block, existing.Data) == secretV1.Data &&
+			existing.RepoID == secretV1.RepoID &&
+			existing.Name == secretV1.Name &&
+			existing.PullRequest == secretV1.PullRequest {
+			log.Debugln("skip unchanged secret")
+			continue
+		}
+
+		secretV1.Data, err = seal(block, secretV1.Data)
+		if err != nil {
+			log.WithError(err).Errorln("encryption failed")
+			return err
+		}
+
 		if insert {
 			log.Debugln("inserting new secret")
 			if err := meddler.Insert(tx, "secrets", secretV1); err != nil {
@@ -93,27 +121,119 @@ func MigrateSecrets(source, target *sql.DB) error {
 }
 
 // EncryptSecrets is a helper function that encrypts all database
-// secrets after being inserted into the Drone database.
+// secrets after being inserted into the Drone database. Secrets
+// that are already encrypted with the key are skipped.
 func EncryptSecrets(target *sql.DB, key string) error {
 	block, err := parseKey(key)
 	if err != nil {
 		logrus.WithError(err).Errorln("cannot read encryption key")
 		return err
 	}
+	logrus.Infof("encryption key fingerprint: %s", keyFingerprint(key))
 
-	secretsV1 := []*SecretV1{}
+	logrus.Infoln("encrypting secrets")
 
-	if err := meddler.QueryAll(target, &secretsV1, secretListQuery); err != nil {
+	err = transformSecrets(target, func(data string) (string, bool, error) {
+		if _, err := decrypt(block, []byte(data)); err == nil {
+			return data, false, nil
+		}
+		ciphertext, err := encrypt(block, data)
+		return string(ciphertext), true, err
+	})
+	if err != nil {
 		return err
 	}
 
-	logrus.Infof("encrypting %d secrets", len(secretsV1))
-	tx, err := target.Begin()
+	logrus.Infof("encryption complete")
+	return nil
+}
+
+// DecryptSecrets is a helper function that decrypts all
+// database secrets, reverting EncryptSecrets. Secrets that
+// cannot be decrypted with the key are assumed to be
+// plaintext and are skipped.
+func DecryptSecrets(target *sql.DB, key string) error {
+	block, err := parseKey(key)
+	if err != nil {
+		logrus.WithError(err).Errorln("cannot read encryption key")
+		return err
+	}
+	logrus.Infof("encryption key fingerprint: %s", keyFingerprint(key))
+
+	logrus.Infoln("decrypting secrets")
+
+	err = transformSecrets(target, func(data string) (string, bool, error) {
+		plaintext, err := decrypt(block, []byte(data))
+		if err != nil {
+			return data, false, nil
+		}
+		return plaintext, true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("decryption complete")
+	return nil
+}
+
+// RotateEncryptionKey is a helper function that decrypts all
+// database secrets with the old key and encrypts them with
+// the new key. Secrets already encrypted with the new key are
+// skipped. If any secret cannot be decrypted with either key
+// the rotation is aborted and no secrets are changed.
+func RotateEncryptionKey(target *sql.DB, oldKey, newKey string) error {
+	oldBlock, err := parseKey(oldKey)
+	if err != nil {
+		logrus.WithError(err).Errorln("cannot read old encryption key")
+		return err
+	}
+	newBlock, err := parseKey(newKey)
+	if err != nil {
+		logrus.WithError(err).Errorln("cannot read new encryption key")
+		return err
+	}
+	logrus.Infof("old encryption key fingerprint: %s", keyFingerprint(oldKey))
+	logrus.Infof("new encryption key fingerprint: %s", keyFingerprint(newKey))
+
+	logrus.Infoln("rotating secret encryption key")
 
+	err = transformSecrets(target, func(data string) (string, bool, error) {
+		plaintext, err := decrypt(oldBlock, []byte(data))
+		if err != nil {
+			if _, err := decrypt(newBlock, []byte(data)); err == nil {
+				return data, false, nil
+			}
+			return data, false, errors.New("cannot decrypt secret with the old encryption key")
+		}
+		ciphertext, err := encrypt(newBlock, plaintext)
+		return string(ciphertext), true, err
+	})
 	if err != nil {
 		return err
 	}
 
+	logrus.Infof("key rotation complete")
+	return nil
+}
+
+// helper function applies the transform function to the data
+// of every secret in the secrets and orgsecrets tables, and
+// updates the changed secrets in a single transaction.
+func transformSecrets(target *sql.DB, fn func(data string) (string, bool, error)) error {
+	// the tables are checked before the transaction starts,
+	// since a failed query aborts a postgres transaction.
+	tables := []string{"secrets"}
+	if tableExists(target, "orgsecrets") {
+		tables = append(tables, "orgsecrets")
+	} else {
+		logrus.Warnln("orgsecrets table not found, skipping organization secrets")
+	}
+
+	tx, err := target.Begin()
+	if err != nil {
+		return err
+	}
 	defer tx.Rollback()
 
 	updateStmt := updateSecretStmt
@@ -121,27 +241,61 @@ func EncryptSecrets(target *sql.DB, key string) error {
 		updateStmt = updateSecretStmtPostgres
 	}
 
-	for _, secretV1 := range secretsV1 {
-		ciphertext, err := encrypt(block, secretV1.Data)
-		if err != nil {
-			logrus.WithError(err).Errorln("encryption failed")
+	for _, table := range tables {
+		secrets := []*secretData{}
+		if err := meddler.QueryAll(tx, &secrets, fmt.Sprintf(secretListQuery, table)); err != nil {
+			logrus.WithError(err).Errorf("cannot list %s", table)
 			return err
 		}
 
-		secretV1.Data = string(ciphertext)
-		if _, err := tx.Exec(updateStmt, secretV1.Data, secretV1.ID); err != nil {
-			logrus.WithError(err).Errorln("update failed")
-			return err
+		var updated int
+		for _, secret := range secrets {
+			log := logrus.WithFields(logrus.Fields{
+				"table":  table,
+				"secret": secret.ID,
+			})
+
+			data, changed, err := fn(secret.Data)
+			if err != nil {
+				log.WithError(err).Errorln("transform failed")
+				return err
+			}
+			if !changed {
+				log.Debugln("skip unchanged secret")
+				continue
+			}
+
+			if _, err := tx.Exec(fmt.Sprintf(updateStmt, table), data, secret.ID); err != nil {
+				log.WithError(err).Errorln("update failed")
+				return err
+			}
+			updated++
 		}
+
+		logrus.Infof("updated %d of %d %s", updated, len(secrets), table)
 	}
 
-	logrus.Infof("encryption complete")
 	return tx.Commit()
 }
 
+// helper function returns true if the table exists in the
+// database.
+func tableExists(db *sql.DB, table string) bool {
+	rows, err := db.Query(fmt.Sprintf(tableExistsQuery, table))
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+const tableExistsQuery = `
+SELECT 1 FROM %s WHERE 1 = 0
+`
+
 const secretListQuery = `
-SELECT *
-FROM secrets
+SELECT secret_id, secret_data
+FROM %s
 `
 
 const secretImportQuery = `
@@ -163,13 +317,13 @@ RESTART WITH %d
 `
 
 const updateSecretStmt = `
-UPDATE secrets
+UPDATE %s
 SET secret_data = ?
 WHERE secret_id = ?
 `
 
 const updateSecretStmtPostgres = `
-UPDATE secrets
+UPDATE %s
 SET secret_data = $1
 WHERE secret_id = $2
 `
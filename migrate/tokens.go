@@ -0,0 +1,110 @@
+package migrate
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/drone/go-scm/scm"
+	"github.com/russross/meddler"
+)
+
+// TokenOverrides maps a namespace to the token used to make
+// requests to the source code management system, in place of
+// the repository owner token. The "*" namespace is the
+// fallback for all other namespaces.
+type TokenOverrides map[string]string
+
+// Parse parses a list of namespace=token pairs
+// and adds them to the overrides.
+func (o TokenOverrides) Parse(pairs []string) error {
+	for _, pair := range pairs {
+		pair = strings.TrimSpace(pair)
+		if pair == "" || strings.HasPrefix(pair, "#") {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		namespace := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || namespace == "" {
+			return fmt.Errorf("invalid token override, expected namespace=token")
+		}
+		o.Set(namespace, strings.TrimSpace(parts[1]))
+	}
+	return nil
+}
+
+// Set sets the token override for the namespace, replacing
+// an existing override for the namespace in a different case,
+// since namespaces are matched ignoring case.
+func (o TokenOverrides) Set(namespace, token string) {
+	for name := range o {
+		if name != namespace && strings.EqualFold(name, namespace) {
+			delete(o, name)
+		}
+	}
+	o[namespace] = token
+}
+
+// ReadFile reads the namespace=token pairs, one per line,
+// from the named file and adds them to the overrides.
+func (o TokenOverrides) ReadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return o.Parse(lines)
+}
+
+// Find returns the token override for the namespace, and
+// false if the repository owner token should be used.
+func (o TokenOverrides) Find(namespace string) (string, bool) {
+	if token, ok := o[namespace]; ok {
+		return token, true
+	}
+	for name, token := range o {
+		if strings.EqualFold(name, namespace) {
+			return token, true
+		}
+	}
+	token, ok := o["*"]
+	return token, ok
+}
+
+// helper function returns the token used to make requests
+// for the repository, and a description of the token owner.
+// The repository owner is only queried if the namespace has
+// no token override.
+func findRepoToken(db meddler.DB, overrides TokenOverrides, repo *RepoV1) (*scm.Token, string, error) {
+	if token, ok := overrides.Find(repo.Namespace); ok {
+		return &scm.Token{Token: token}, "overridden by provided token", nil
+	}
+	user := &UserV1{}
+	if err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, repo.UserID)); err != nil {
+		return nil, "", err
+	}
+	return userToken(user), user.Login, nil
+}
+
+// helper function returns the user oauth token.
+func userToken(user *UserV1) *scm.Token {
+	tok := &scm.Token{
+		Token:   user.Token,
+		Refresh: user.Refresh,
+	}
+	if user.Expiry > 0 {
+		tok.Expires = time.Unix(user.Expiry, 0)
+	}
+	return tok
+}
@@ -0,0 +1,51 @@
+package migrate
+
+import "testing"
+
+func TestTokenOverrides(t *testing.T) {
+	overrides := TokenOverrides{}
+	err := overrides.Parse([]string{
+		"# comment",
+		"octocat=token-1",
+		"Spaceghost = token-2",
+		"spaceghost=token-3",
+		"*=token-4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		namespace string
+		token     string
+		ok        bool
+	}{
+		{namespace: "octocat", token: "token-1", ok: true},
+		{namespace: "OctoCat", token: "token-1", ok: true},
+		{namespace: "SpaceGhost", token: "token-3", ok: true},
+		{namespace: "other", token: "token-4", ok: true},
+	}
+	for _, test := range tests {
+		token, ok := overrides.Find(test.namespace)
+		if token != test.token || ok != test.ok {
+			t.Errorf("%s: want %q %v, got %q %v", test.namespace, test.token, test.ok, token, ok)
+		}
+	}
+
+	if len(overrides) != 3 {
+		t.Errorf("want namespaces that differ by case replaced, got %v", overrides)
+	}
+
+	delete(overrides, "*")
+	if _, ok := overrides.Find("other"); ok {
+		t.Errorf("want no override without a fallback")
+	}
+}
+
+func TestTokenOverridesInvalid(t *testing.T) {
+	for _, pair := range []string{"octocat", "=token"} {
+		if err := (TokenOverrides{}).Parse([]string{pair}); err == nil {
+			t.Errorf("%s: want error", pair)
+		}
+	}
+}
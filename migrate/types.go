@@ -3,6 +3,7 @@ package migrate
 import (
 	"encoding/base64"
 	"encoding/json"
+	"strings"
 )
 
 type (
@@ -312,6 +313,15 @@ type (
 		Data   []byte `meddler:"log_data"`
 	}
 
+	// LogsMetaV0 is the Drone 0.x repository and build
+	// metadata for a step's logs.
+	LogsMetaV0 struct {
+		ProcID       int64  `meddler:"proc_id"`
+		ProcName     string `meddler:"proc_name"`
+		BuildNumber  int64  `meddler:"build_number"`
+		RepoFullname string `meddler:"repo_full_name"`
+	}
+
 	// LogsV1 is a Drone 1.x logs.
 	LogsV1 struct {
 		ID   int64  `meddler:"log_id"`
@@ -330,6 +340,13 @@ type (
 		Conceal    bool     `meddler:"secret_conceal"`
 	}
 
+	// repoSecretV0 is a Drone 0.x secret with the full name
+	// of the repository.
+	repoSecretV0 struct {
+		*SecretV0
+		RepoFullname string
+	}
+
 	// SecretV1 is a Drone 1.x secret.
 	SecretV1 struct {
 		ID              int64  `meddler:"secret_id"`
@@ -350,6 +367,37 @@ type (
 		PullRequestPush bool   `meddler:"secret_pull_request_push"`
 	}
 
+	// OrgSecretV1 is a Drone 1.x organization secret.
+	OrgSecretV1 struct {
+		ID              int64  `meddler:"secret_id,pk"`
+		Namespace       string `meddler:"secret_namespace"`
+		Name            string `meddler:"secret_name"`
+		Type            string `meddler:"secret_type"`
+		Data            string `meddler:"secret_data"`
+		PullRequest     bool   `meddler:"secret_pull_request"`
+		PullRequestPush bool   `meddler:"secret_pull_request_push"`
+	}
+
+	// repoSecretV1 is a Drone 1.x secret with the namespace
+	// and slug of the repository.
+	repoSecretV1 struct {
+		ID              int64  `meddler:"secret_id"`
+		RepoID          int64  `meddler:"secret_repo_id"`
+		Name            string `meddler:"secret_name"`
+		Data            string `meddler:"secret_data"`
+		PullRequest     bool   `meddler:"secret_pull_request"`
+		PullRequestPush bool   `meddler:"secret_pull_request_push"`
+		Namespace       string `meddler:"repo_namespace"`
+		Slug            string `meddler:"repo_slug"`
+	}
+
+	// secretData is the encrypted or plaintext data of a
+	// Drone 1.x secret or organization secret.
+	secretData struct {
+		ID   int64  `meddler:"secret_id"`
+		Data string `meddler:"secret_data"`
+	}
+
 	// RegistryV0 is a Drone 0.x registry.
 	RegistryV0 struct {
 		ID           int64  `meddler:"registry_id"`
@@ -379,10 +427,11 @@ type (
 
 	// AuthConfig contains authorization information for connecting to a Registry.
 	AuthConfig struct {
-		Email    string `json:"email,omitempty"`
-		Username string `json:"username,omitempty"`
-		Password string `json:"password,omitempty"`
-		Auth     string `json:"auth,omitempty"`
+		Email         string `json:"email,omitempty"`
+		Username      string `json:"username,omitempty"`
+		Password      string `json:"password,omitempty"`
+		Auth          string `json:"auth,omitempty"`
+		IdentityToken string `json:"identitytoken,omitempty"`
 	}
 
 	InsertResponse struct {
@@ -390,6 +439,16 @@ type (
 		Count	int64	`meddler:"count"`
 	}
 
+	// PermV0 is a Drone 0.x repository permission.
+	PermV0 struct {
+		UserID int64 `meddler:"perm_user_id"`
+		RepoID int64 `meddler:"perm_repo_id"`
+		Pull   bool  `meddler:"perm_pull"`
+		Push   bool  `meddler:"perm_push"`
+		Admin  bool  `meddler:"perm_admin"`
+		Synced int64 `meddler:"perm_synced"`
+	}
+
 	PermV1 struct {
 		UserID  int64  `meddler:"perm_user_id"`
 		RepoUID string `meddler:"perm_repo_uid"`
@@ -404,18 +463,56 @@ type (
 
 func (c AuthConfig) MarshalJSON() ([]byte, error) {
 	result := struct {
-		Auth  string `json:"auth,omitempty"`
-		Email string `json:"email,omitempty"`
+		Auth          string `json:"auth,omitempty"`
+		Email         string `json:"email,omitempty"`
+		IdentityToken string `json:"identitytoken,omitempty"`
 	}{
-		Email: c.Email,
+		Email:         c.Email,
+		IdentityToken: c.IdentityToken,
 	}
 
-	credentials := []byte(c.Username + ":" + c.Password)
+	// token-only registries do not have a username
+	// and password, in which case auth is omitted.
+	if c.Username != "" || c.Password != "" {
+		credentials := []byte(c.Username + ":" + c.Password)
 
-	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(credentials)))
-	base64.StdEncoding.Encode(encoded, credentials)
+		encoded := make([]byte, base64.StdEncoding.EncodedLen(len(credentials)))
+		base64.StdEncoding.Encode(encoded, credentials)
 
-	result.Auth = string(encoded)
+		result.Auth = string(encoded)
+	}
 
 	return json.Marshal(result)
 }
+
+func (c *AuthConfig) UnmarshalJSON(data []byte) error {
+	result := struct {
+		Auth          string `json:"auth"`
+		Email         string `json:"email"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	}{}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+
+	c.Email = result.Email
+	c.Username = result.Username
+	c.Password = result.Password
+	c.IdentityToken = result.IdentityToken
+
+	if result.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(result.Auth)
+		if err != nil {
+			return err
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		c.Username = parts[0]
+		if len(parts) == 2 {
+			c.Password = parts[1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package migrate
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAuthConfigMarshal(t *testing.T) {
+	tests := []struct {
+		name   string
+		config AuthConfig
+		want   string
+	}{
+		{
+			name:   "password",
+			config: AuthConfig{Username: "octocat", Password: "correct-horse", Email: "octocat@github.com"},
+			want:   `{"auth":"b2N0b2NhdDpjb3JyZWN0LWhvcnNl","email":"octocat@github.com"}`,
+		},
+		{
+			name:   "token",
+			config: AuthConfig{IdentityToken: "battery-staple"},
+			want:   `{"identitytoken":"battery-staple"}`,
+		},
+		{
+			name:   "password and token",
+			config: AuthConfig{Username: "octocat", Password: "correct-horse", IdentityToken: "battery-staple"},
+			want:   `{"auth":"b2N0b2NhdDpjb3JyZWN0LWhvcnNl","identitytoken":"battery-staple"}`,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := json.Marshal(test.config)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: want %s, got %s", test.name, test.want, got)
+		}
+
+		var config AuthConfig
+		if err := json.Unmarshal(got, &config); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if config != test.config {
+			t.Errorf("%s: want %+v after round trip, got %+v", test.name, test.config, config)
+		}
+	}
+}
+
+func TestAuthConfigUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want AuthConfig
+		err  bool
+	}{
+		{
+			name: "auth",
+			data: `{"auth":"b2N0b2NhdDpjb3JyZWN0OmhvcnNl"}`,
+			want: AuthConfig{Username: "octocat", Password: "correct:horse"},
+		},
+		{
+			name: "username and password",
+			data: `{"username":"octocat","password":"correct-horse"}`,
+			want: AuthConfig{Username: "octocat", Password: "correct-horse"},
+		},
+		{
+			name: "username only",
+			data: `{"auth":"b2N0b2NhdA=="}`,
+			want: AuthConfig{Username: "octocat"},
+		},
+		{
+			name: "invalid auth",
+			data: `{"auth":"not base64"}`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		var got AuthConfig
+		err := json.Unmarshal([]byte(test.data), &got)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: want error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: want %+v, got %+v", test.name, test.want, got)
+		}
+	}
+}
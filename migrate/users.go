@@ -1,21 +1,64 @@
 package migrate
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/dchest/uniuri"
+	"github.com/drone/go-scm/scm"
+	"github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
 
 	"github.com/russross/meddler"
 )
 
+// UserOptions configures the user migration.
+type UserOptions struct {
+	// PreserveTokens sets the 1.x user token to the 0.x api
+	// token, so existing tokens keep working.
+	PreserveTokens bool
+
+	// TokenFile is the path of the login to token mapping
+	// written after migration (optional). TokenFormat is one
+	// of json, csv or env. For the env format TokenFile is a
+	// directory with one <login>.env file per user.
+	TokenFile   string
+	TokenFormat string
+
+	// Server is the Drone server address included in the
+	// env token files (optional).
+	Server string
+
+	// Admins is a list of logins that are granted admin
+	// access in addition to the 0.x admins.
+	Admins []string
+
+	// MachineUsers is a list of logins created as 1.x
+	// machine users with generated tokens.
+	MachineUsers []string
+
+	// ActivateAll migrates every user as active, ignoring
+	// the 0.x active flag, for installations that did not
+	// set the flag.
+	ActivateAll bool
+}
+
 // MigrateUsers migrates the user accounts from the V0
 // database to the V1 database.
-func MigrateUsers(source, target *sql.DB) error {
+func MigrateUsers(source, target *sql.DB, opts UserOptions) error {
 	usersV0 := []*UserV0{}
 
 	if err := meddler.QueryAll(source, &usersV0, userImportQuery); err != nil {
@@ -24,6 +67,10 @@ func MigrateUsers(source, target *sql.DB) error {
 
 	logrus.Infof("migrating %d users", len(usersV0))
 
+	if opts.ActivateAll {
+		logrus.Infoln("ignoring the 0.x active flag, migrating all users as active")
+	}
+
 	tx, err := target.Begin()
 
 	if err != nil {
@@ -33,6 +80,7 @@ func MigrateUsers(source, target *sql.DB) error {
 	defer tx.Rollback()
 
 	var sequence int64
+	tokens := map[string]string{}
 	for _, userV0 := range usersV0 {
 		if userV0.ID > sequence {
 			sequence = userV0.ID
@@ -50,8 +98,8 @@ func MigrateUsers(source, target *sql.DB) error {
 			Login:     userV0.Login,
 			Email:     userV0.Email,
 			Machine:   false,
-			Admin:     false,
-			Active:    true,
+			Admin:     userV0.Admin || containsFold(opts.Admins, userV0.Login),
+			Active:    userV0.Active || opts.ActivateAll,
 			Avatar:    userV0.Avatar,
 			Syncing:   false,
 			Synced:    0,
@@ -65,7 +113,8 @@ func MigrateUsers(source, target *sql.DB) error {
 		}
 
 		var insert bool
-		err = meddler.QueryRow(tx, &UserV1{}, fmt.Sprintf("SELECT * FROM users WHERE user_id = %d", userV1.ID))
+		existing := &UserV1{}
+		err = meddler.QueryRow(tx, existing, fmt.Sprintf("SELECT * FROM users WHERE user_id = %d", userV1.ID))
 		if err != nil && err.Error() == "sql: no rows in result set" {
 			insert = true
 		} else if err != nil {
@@ -73,6 +122,18 @@ func MigrateUsers(source, target *sql.DB) error {
 			return err
 		}
 
+		switch {
+		case opts.PreserveTokens && userV0.Hash != "":
+			userV1.Hash = legacyToken(userV0.Login, userV0.Hash)
+		case opts.PreserveTokens:
+			log.Warnln("user has no token, generating a new token")
+		case existing.Hash != "":
+			// keep the token generated by a previous run, which
+			// may already have been distributed.
+			userV1.Hash = existing.Hash
+		}
+		tokens[userV1.Login] = userV1.Hash
+
 		if insert {
 			log.Debugln("inserting new user")
 			if err := meddler.Insert(tx, "users", userV1); err != nil {
@@ -100,8 +161,399 @@ func MigrateUsers(source, target *sql.DB) error {
 		}
 	}
 
+	// the machine users are created after the sequence is
+	// reset so that the generated ids do not collide.
+	for _, login := range opts.MachineUsers {
+		hash, err := migrateMachineUser(tx, login, opts)
+		if err != nil {
+			return err
+		}
+		tokens[login] = hash
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if opts.TokenFile != "" {
+		if err := writeTokens(tokens, opts); err != nil {
+			logrus.WithError(err).Errorln("failed to write token file")
+			return err
+		}
+		logrus.Infof("wrote %d tokens to %s", len(tokens), opts.TokenFile)
+	}
+
 	logrus.Infoln("migration complete")
-	return tx.Commit()
+	return nil
+}
+
+// helper function creates the named machine user, or updates
+// the machine user created by a previous run, and returns the
+// token. An existing user account with the same login is not
+// converted to a machine user.
+func migrateMachineUser(tx *sql.Tx, login string, opts UserOptions) (string, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"login":   login,
+		"machine": true,
+	})
+
+	query := userLoginQuery
+	if meddler.Default == meddler.PostgreSQL {
+		query = userLoginQueryPostgres
+	}
+
+	existing := &UserV1Update{}
+	err := meddler.QueryRow(tx, existing, query, login)
+	if err != nil && err != sql.ErrNoRows {
+		log.WithError(err).Errorln("error querying for existing user")
+		return "", err
+	}
+
+	if err == nil && !existing.Machine {
+		err = fmt.Errorf("cannot create machine user %s, a user account with the same login exists", login)
+		log.WithError(err).Errorln("failed to create machine user")
+		return "", err
+	}
+
+	if err == nil {
+		log.Debugln("updating existing machine user")
+		existing.Machine = true
+		existing.Active = true
+		existing.Updated = time.Now().Unix()
+		if err := meddler.Update(tx, "users", existing); err != nil {
+			log.WithError(err).Errorln("failed to update existing machine user")
+			return "", err
+		}
+		return existing.Hash, nil
+	}
+
+	log.Debugln("inserting new machine user")
+	// the id is generated by the database, which requires
+	// the pk to be marked.
+	userV1 := &UserV1Update{
+		Login:   login,
+		Machine: true,
+		Admin:   containsFold(opts.Admins, login),
+		Active:  true,
+		Created: time.Now().Unix(),
+		Updated: time.Now().Unix(),
+		Hash:    uniuri.NewLen(32),
+	}
+	if err := meddler.Insert(tx, "users", userV1); err != nil {
+		log.WithError(err).Errorln("failed to insert new machine user")
+		return "", err
+	}
+	return userV1.Hash, nil
+}
+
+// helper function returns true if the list contains the
+// string, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function writes the login to token mapping to the
+// token file in the configured format.
+func writeTokens(tokens map[string]string, opts UserOptions) error {
+	var logins []string
+	for login := range tokens {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+
+	switch opts.TokenFormat {
+	case "", "json":
+		data, err := json.MarshalIndent(tokens, "", "  ")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(opts.TokenFile, data, 0600)
+	case "csv":
+		f, err := os.OpenFile(opts.TokenFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w := csv.NewWriter(f)
+		w.Write([]string{"login", "token"})
+		for _, login := range logins {
+			w.Write([]string{login, tokens[login]})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		return f.Close()
+	case "env":
+		if err := os.MkdirAll(opts.TokenFile, 0700); err != nil {
+			return err
+		}
+		for _, login := range logins {
+			var buf strings.Builder
+			if opts.Server != "" {
+				fmt.Fprintf(&buf, "DRONE_SERVER=%s\n", opts.Server)
+			}
+			fmt.Fprintf(&buf, "DRONE_TOKEN=%s\n", tokens[login])
+			name := strings.NewReplacer("/", "_", "\\", "_").Replace(login) + ".env"
+			if err := ioutil.WriteFile(filepath.Join(opts.TokenFile, name), []byte(buf.String()), 0600); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown token format: %s", opts.TokenFormat)
+	}
+}
+
+// UpdateUsers updates the user login, email and avatar
+// with the values fetched from the source code management
+// system using the user token, and writes a report of renamed
+// users and users whose account or token no longer works to w.
+func UpdateUsers(db *sql.DB, client *scm.Client, w io.Writer, dryRun bool) error {
+	users := []*UserV1{}
+	var result error
+
+	if err := meddler.QueryAll(db, &users, userImportQuery); err != nil {
+		return err
+	}
+
+	logrus.Infoln("updating user metadata")
+
+	collisionQuery := userCollisionQuery
+	if meddler.Default == meddler.PostgreSQL {
+		collisionQuery = userCollisionQueryPostgres
+	}
+
+	var updated, flagged int
+	for _, user := range users {
+		log := logrus.WithFields(logrus.Fields{
+			"id":    user.ID,
+			"login": user.Login,
+		})
+
+		if user.Machine {
+			continue
+		}
+
+		tok := userToken(user)
+
+		ctx := scm.WithContext(context.Background(), tok)
+
+		remoteUser, res, err := client.Users.Find(ctx)
+		if err != nil {
+			log.WithError(err).Warnln("failed to get remote user")
+			fmt.Fprintf(w, "%s: %s: %s\n", user.Login, remoteUserStatus(res), err)
+			flagged++
+			continue
+		}
+
+		if remoteUser.Login != user.Login {
+			existing := &UserV1{}
+			err := meddler.QueryRow(db, existing, collisionQuery, remoteUser.Login, user.ID)
+			if err == nil {
+				log.Warnf("cannot rename user, login already exists: %s", existing.Login)
+				fmt.Fprintf(w, "%s: renamed to %s, login collision with user id %d\n", user.Login, remoteUser.Login, existing.ID)
+				flagged++
+				continue
+			}
+			if err != sql.ErrNoRows {
+				log.WithError(err).Errorln("error querying for existing user")
+				result = multierror.Append(result, err)
+				continue
+			}
+			fmt.Fprintf(w, "%s: renamed to %s\n", user.Login, remoteUser.Login)
+		}
+
+		changed := remoteUser.Login != user.Login ||
+			(remoteUser.Email != "" && remoteUser.Email != user.Email) ||
+			(remoteUser.Avatar != "" && remoteUser.Avatar != user.Avatar)
+		if !changed {
+			log.Debugln("user is up to date")
+			continue
+		}
+
+		user.Login = remoteUser.Login
+		if remoteUser.Email != "" {
+			user.Email = remoteUser.Email
+		}
+		if remoteUser.Avatar != "" {
+			user.Avatar = remoteUser.Avatar
+		}
+		user.Updated = time.Now().Unix()
+		updated++
+
+		if dryRun {
+			continue
+		}
+
+		if err := meddler.Update(db, "users", (*UserV1Update)(user)); err != nil {
+			log.WithError(err).Errorln("failed to update user")
+			result = multierror.Append(result, err)
+			continue
+		}
+
+		log.Debugln("updated user")
+	}
+
+	logrus.Infof("updated %d users, %d users flagged", updated, flagged)
+	return result
+}
+
+// TokenRefresher refreshes an expired oauth token.
+type TokenRefresher interface {
+	Refresh(token *scm.Token) error
+}
+
+// CheckTokens validates the user tokens with the source code
+// management system and writes a per-user status report to w.
+// If a refresher is provided, expired tokens are refreshed and
+// the refreshed tokens are written back to the database.
+func CheckTokens(db *sql.DB, client *scm.Client, refresher TokenRefresher, w io.Writer) error {
+	users := []*UserV1{}
+	var result error
+
+	if err := meddler.QueryAll(db, &users, userImportQuery); err != nil {
+		return err
+	}
+
+	logrus.Infof("checking %d user tokens", len(users))
+
+	var valid, invalid, refreshed int
+	for _, user := range users {
+		log := logrus.WithFields(logrus.Fields{
+			"id":    user.ID,
+			"login": user.Login,
+		})
+
+		if user.Machine {
+			continue
+		}
+
+		if user.Token == "" {
+			fmt.Fprintf(w, "%s: no token\n", user.Login)
+			invalid++
+			continue
+		}
+
+		tok := userToken(user)
+		canRefresh := refresher != nil && tok.Refresh != ""
+
+		if user.Expiry > 0 && tok.Expires.Before(time.Now().Add(time.Minute)) {
+			if !canRefresh {
+				reason := "no refresh token"
+				if refresher == nil {
+					reason = "refresh not supported"
+				}
+				fmt.Fprintf(w, "%s: expired at %s, %s\n", user.Login, tok.Expires.Format(time.RFC3339), reason)
+				invalid++
+				continue
+			}
+			log.Debugln("refreshing expired token")
+			if err := refresher.Refresh(tok); err != nil {
+				log.WithError(err).Warnln("failed to refresh token")
+				fmt.Fprintf(w, "%s: refresh failed: %s\n", user.Login, err)
+				invalid++
+				continue
+			}
+		}
+
+		ctx := scm.WithContext(context.Background(), tok)
+
+		remoteUser, res, err := client.Users.Find(ctx)
+		if err != nil && res != nil && res.Status == 401 && canRefresh && tok.Token == user.Token {
+			// the token may be expired even if the stored
+			// expiry is missing or incorrect.
+			log.Debugln("refreshing rejected token")
+			if err := refresher.Refresh(tok); err != nil {
+				log.WithError(err).Warnln("failed to refresh token")
+			} else {
+				remoteUser, res, err = client.Users.Find(ctx)
+			}
+		}
+
+		// the token is refreshed in place, including by the
+		// client transport, and must be saved because the
+		// previous refresh token may no longer be valid.
+		var saved bool
+		if tok.Token != user.Token || tok.Refresh != user.Refresh {
+			user.Token = tok.Token
+			user.Refresh = tok.Refresh
+			if !tok.Expires.IsZero() {
+				user.Expiry = tok.Expires.Unix()
+			}
+			user.Updated = time.Now().Unix()
+			if err := meddler.Update(db, "users", (*UserV1Update)(user)); err != nil {
+				log.WithError(err).Errorln("failed to save refreshed token")
+				result = multierror.Append(result, err)
+				continue
+			}
+			log.Debugln("saved refreshed token")
+			saved = true
+			refreshed++
+		}
+
+		if err != nil {
+			log.WithError(err).Warnln("failed to get remote user")
+			fmt.Fprintf(w, "%s: %s: %s\n", user.Login, remoteUserStatus(res), err)
+			invalid++
+			continue
+		}
+
+		status := "ok"
+		if saved {
+			status = "ok, refreshed"
+		}
+		if remoteUser.Login != user.Login {
+			status += fmt.Sprintf(", remote login is %s", remoteUser.Login)
+		}
+		fmt.Fprintf(w, "%s: %s\n", user.Login, status)
+		valid++
+	}
+
+	logrus.Infof("%d valid tokens, %d invalid tokens, %d tokens refreshed", valid, invalid, refreshed)
+	return result
+}
+
+// helper function returns a short description of the failed
+// remote user lookup.
+func remoteUserStatus(res *scm.Response) string {
+	if res == nil {
+		return "lookup failed"
+	}
+	switch res.Status {
+	case 401:
+		return "token invalid"
+	case 403, 404, 410:
+		return "account not found"
+	default:
+		return fmt.Sprintf("lookup failed (status %d)", res.Status)
+	}
+}
+
+// helper function returns the 0.x api token of the user.
+// In 0.x the user hash is the secret used to sign the token,
+// a json web token with the login, while in 1.x the token is
+// stored as the user hash. The 0.x token does not expire.
+func legacyToken(login, secret string) string {
+	header, _ := json.Marshal(map[string]string{
+		"alg": "HS256",
+		"typ": "JWT",
+	})
+	claims, _ := json.Marshal(map[string]string{
+		"text": login,
+		"type": "user",
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 }
 
 // DumpTokens dumps the database tokens from the V0
@@ -130,6 +582,22 @@ FROM
 	users
 `
 
+const userLoginQuery = `
+SELECT * FROM users WHERE lower(user_login) = lower(?)
+`
+
+const userLoginQueryPostgres = `
+SELECT * FROM users WHERE lower(user_login) = lower($1)
+`
+
+const userCollisionQuery = `
+SELECT * FROM users WHERE lower(user_login) = lower(?) AND user_id != ?
+`
+
+const userCollisionQueryPostgres = `
+SELECT * FROM users WHERE lower(user_login) = lower($1) AND user_id != $2
+`
+
 const updateUserSeq = `
 ALTER SEQUENCE users_user_id_seq
 RESTART WITH %d
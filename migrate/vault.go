@@ -0,0 +1,156 @@
+package migrate
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// VaultOptions configures the export of secrets to Vault.
+type VaultOptions struct {
+	// Addr and Token are the Vault server address and
+	// token used to write the secrets.
+	Addr  string
+	Token string
+
+	// Mount is the path of the KV version 2 secrets engine
+	// and Prefix is the path prefix within the engine.
+	Mount  string
+	Prefix string
+
+	// Bundle is the path of a JSON file the secrets are
+	// written to instead of the Vault server (optional).
+	Bundle string
+
+	// Rules are the repository rename rules, applied to the
+	// repository names in the secret paths (optional).
+	Rules *RenameRules
+}
+
+// ExportVault exports the secrets and registry credentials
+// from the V0 database to Vault KV version 2 secrets, with
+// paths of the form <prefix>/<namespace>/<repo>/<name>. The
+// secret is stored in the value key. Registry credentials
+// are stored as a docker config with the name .dockerconfigjson.
+// The secrets are restricted to the repository and the 0.x
+// events with the x-drone-repos and x-drone-events keys used
+// by the vault extension.
+func ExportVault(source *sql.DB, opts VaultOptions) error {
+	secretsV0, err := listRepoSecretsV0(source)
+	if err != nil {
+		return err
+	}
+
+	registriesV0 := []*RegistryV0{}
+	if err := meddler.QueryAll(source, &registriesV0, registryImportQuery); err != nil {
+		return err
+	}
+
+	logrus.Infof("exporting %d secrets and %d registries", len(secretsV0), len(registriesV0))
+
+	if opts.Mount == "" {
+		opts.Mount = "secret"
+	}
+
+	bundle := map[string]map[string]string{}
+	for _, secretV0 := range secretsV0 {
+		slug := opts.Rules.Slug(secretV0.RepoFullname)
+		name := path.Join(opts.Prefix, slug, secretV0.Name)
+		bundle[name] = map[string]string{
+			"value":          secretV0.Value,
+			"x-drone-repos":  slug,
+			"x-drone-events": strings.Join(secretEvents(secretV0.Events), ","),
+		}
+	}
+
+	for repoFullname, config := range groupRegistries(registriesV0) {
+		slug := opts.Rules.Slug(repoFullname)
+		data, err := json.Marshal(config)
+		if err != nil {
+			logrus.WithError(err).WithField("repo", slug).Errorln("failed to build docker config")
+			return err
+		}
+		name := path.Join(opts.Prefix, slug, ".dockerconfigjson")
+		bundle[name] = map[string]string{
+			"value":         string(data),
+			"x-drone-repos": slug,
+		}
+	}
+
+	if opts.Bundle != "" {
+		// the bundle is keyed by the path used with the
+		// vault kv put command, which includes the mount.
+		out := map[string]map[string]string{}
+		for name, data := range bundle {
+			out[path.Join(opts.Mount, name)] = data
+		}
+		data, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(opts.Bundle, data, 0600); err != nil {
+			logrus.WithError(err).Errorln("export failed")
+			return err
+		}
+		logrus.Infof("exported %d secrets to %s", len(out), opts.Bundle)
+		return nil
+	}
+
+	var names []string
+	for name := range bundle {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		log := logrus.WithField("path", name)
+		if err := putVault(opts, name, bundle[name]); err != nil {
+			log.WithError(err).Errorln("export failed")
+			return err
+		}
+		log.Debugln("export complete")
+	}
+
+	logrus.Infof("exported %d secrets to vault", len(names))
+	return nil
+}
+
+// helper function writes the secret data to the Vault KV
+// version 2 secrets engine.
+func putVault(opts VaultOptions, name string, data map[string]string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"data": data,
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(opts.Addr, "/") + "/v1/" + path.Join(opts.Mount, "data", name)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", opts.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode > 299 {
+		out, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("vault: %s: %s", res.Status, strings.TrimSpace(string(out)))
+	}
+	return nil
+}